@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AssignmentStrategy selects how crossings of head-to-head races are
+// assigned to teams
+type AssignmentStrategy string
+
+const (
+	// Teams alternate at each barrier
+	RoundRobin AssignmentStrategy = "round_robin"
+	// The team expected at the barrier according to its recent lap
+	// times
+	Predictive AssignmentStrategy = "predictive"
+)
+
+// Number of recent laps (or barrier-to-barrier segments) used to
+// predict the next crossing of a team
+const predictionLaps = 3
+
+// SQL interface
+
+func (e *AssignmentStrategy) Scan(value interface{}) error {
+	// NULL for races stored before the column was added
+	s, _ := value.(string)
+	*e = AssignmentStrategy(s)
+	return nil
+}
+
+func (e AssignmentStrategy) Value() (driver.Value, error) {
+	return string(e), nil
+}
+
+// TeamAssigner decides which team made a crossing of a head-to-head
+// race. Operators can correct the decision via POST /crossings/:id.
+type TeamAssigner interface {
+	// assignTeam returns the team of the new crossing. race.Track
+	// (with Barriers) and race.Pauses must be preloaded.
+	assignTeam(tx *gorm.DB, race *Race, crossing *Crossing) (CrossingTeam, error)
+}
+
+var teamAssigners = map[AssignmentStrategy]TeamAssigner{
+	RoundRobin: roundRobinAssigner{},
+	Predictive: predictiveAssigner{},
+}
+
+func validateAssignmentStrategy(strategy AssignmentStrategy) error {
+	if _, ok := teamAssigners[strategy]; !ok && strategy != "" {
+		return fmt.Errorf("unsupported assignment strategy '%s'", string(strategy))
+	}
+	return nil
+}
+
+// teamAssigner returns the assigner selected for the race (round
+// robin by default)
+func (r *Race) teamAssigner() TeamAssigner {
+	if assigner, ok := teamAssigners[r.AssignmentStrategy]; ok {
+		return assigner
+	}
+	return teamAssigners[RoundRobin]
+}
+
+// roundRobinAssigner switches teams at each barrier in round robin
+// fashion.
+type roundRobinAssigner struct{}
+
+func (roundRobinAssigner) assignTeam(tx *gorm.DB, race *Race, crossing *Crossing) (CrossingTeam, error) {
+	// Only earlier crossings are considered, because replayed
+	// crossings can be older than the already stored ones.
+	var last Crossing
+	err := tx.Where("race_id = ? AND barrier_id = ? AND ignored = ? AND paused = ? AND time < ?",
+		race.ID, crossing.BarrierId, false, false, crossing.Time).
+		Order("time DESC").Order("id DESC").Limit(1).Find(&last).Error
+	if err != nil {
+		return TeamNotSet, err
+	}
+	switch {
+	case last.ID == 0:
+		// First crossing in a race belongs to the team
+		// whose lap barrier was crossed
+		return race.track().lapBarrierTeam(crossing.BarrierId), nil
+	case last.Team == TeamA:
+		return TeamB, nil
+	case last.Team == TeamB:
+		return TeamA, nil
+	}
+	return TeamNotSet, nil
+}
+
+// predictiveAssigner assigns the crossing to the team whose predicted
+// arrival at the barrier is closest to the crossing time. The
+// prediction is based on the team's last crossing and its recent lap
+// times (or times between the two barriers). Until both teams can be
+// predicted (e.g. during the first lap), round robin is used.
+type predictiveAssigner struct{}
+
+func (predictiveAssigner) assignTeam(tx *gorm.DB, race *Race, crossing *Crossing) (CrossingTeam, error) {
+	var earlier []Crossing
+	err := tx.Where("race_id = ? AND ignored = ? AND paused = ? AND team <> ? AND time < ?",
+		race.ID, false, false, TeamNotSet, crossing.Time).
+		Order("time").Order("id").Find(&earlier).Error
+	if err != nil {
+		return TeamNotSet, err
+	}
+	ts := time.Time(crossing.Time)
+	errA, okA := predictionError(race, earlier, TeamA, crossing.BarrierId, ts)
+	errB, okB := predictionError(race, earlier, TeamB, crossing.BarrierId, ts)
+	if !okA || !okB {
+		return roundRobinAssigner{}.assignTeam(tx, race, crossing)
+	}
+	if errB < errA {
+		return TeamB, nil
+	}
+	return TeamA, nil
+}
+
+// predictionError returns how far ts is from the predicted arrival of
+// the team at the barrier. ok is false if there is not enough data for
+// the prediction.
+func predictionError(race *Race, crossings []Crossing, team CrossingTeam, barrierId uint, ts time.Time) (time.Duration, bool) {
+	var own []Crossing
+	for _, c := range crossings {
+		if c.Team == team {
+			own = append(own, c)
+		}
+	}
+	if len(own) == 0 {
+		return 0, false
+	}
+	last := own[len(own)-1]
+	var expected time.Duration
+	var ok bool
+	if last.BarrierId == barrierId {
+		// the team has not crossed another barrier since; it
+		// should complete the whole lap
+		expected, ok = recentSegment(race, own, barrierId, barrierId)
+		if !ok {
+			expected, ok = recentSegment(race, own, race.track().lapBarrier(team), race.track().lapBarrier(team))
+		}
+	} else {
+		expected, ok = recentSegment(race, own, last.BarrierId, barrierId)
+		if !ok {
+			// assume the barriers are half a lap apart
+			expected, ok = recentSegment(race, own, race.track().lapBarrier(team), race.track().lapBarrier(team))
+			expected /= 2
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+	elapsed := ts.Sub(time.Time(last.Time)) - pausedDuration(race.Pauses, time.Time(last.Time), ts)
+	diff := elapsed - expected
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff, true
+}
+
+// recentSegment returns the mean time (without pauses) the team needed
+// recently to get from barrier from to barrier to (whole laps if from
+// == to). crossings of the team must be ordered by time.
+func recentSegment(race *Race, crossings []Crossing, from, to uint) (time.Duration, bool) {
+	var sum time.Duration
+	n := 0
+	for i := len(crossings) - 1; i > 0 && n < predictionLaps; i-- {
+		if crossings[i].BarrierId != to {
+			continue
+		}
+		// the closest earlier crossing of the from barrier
+		for j := i - 1; j >= 0; j-- {
+			if crossings[j].BarrierId == to && from != to {
+				break
+			}
+			if crossings[j].BarrierId == from {
+				start, end := time.Time(crossings[j].Time), time.Time(crossings[i].Time)
+				sum += end.Sub(start) - pausedDuration(race.Pauses, start, end)
+				n++
+				break
+			}
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / time.Duration(n), true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// AuditEntry records a change made via the API (or by the backend
+// itself, e.g. the race supervisor). The audit table is append-only.
+type AuditEntry struct {
+	ID   uint `gorm:"primaryKey" json:"id"`
+	Time Time `gorm:"index" json:"time"`
+	// Who made the change
+	Actor string `json:"actor"`
+	// API call, e.g. "POST /crossings/:id"
+	Action string `json:"action"`
+	// Changed entity (e.g. "crossing") and its ID
+	Entity   string `gorm:"index" json:"entity"`
+	EntityID uint   `json:"entityId"`
+	// Race the change relates to (0 if none)
+	RaceID uint `gorm:"index" json:"raceId"`
+	// JSON values of the entity before and after the change (null
+	// for created and deleted entities)
+	Before AuditValue `json:"before"`
+	After  AuditValue `json:"after"`
+	// Set if the entry undoes or redoes another entry (see undo.go)
+	UndoOf *uint `json:"undoOf,omitempty"`
+	RedoOf *uint `json:"redoOf,omitempty"`
+}
+
+// AuditValue is a JSON-encoded value stored as text
+type AuditValue []byte
+
+func (v AuditValue) MarshalJSON() ([]byte, error) {
+	if len(v) == 0 {
+		return []byte("null"), nil
+	}
+	return v, nil
+}
+
+// SQL interface
+
+func (v *AuditValue) Scan(value interface{}) error {
+	switch value := value.(type) {
+	case string:
+		*v = AuditValue(value)
+	case []byte:
+		*v = append(AuditValue(nil), value...)
+	default:
+		*v = nil
+	}
+	return nil
+}
+
+func (v AuditValue) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	return string(v), nil
+}
+
+// Context key marking requests already recorded by the handler
+const auditedKey = "audited"
+
+// auditActor returns who made the request: the logged in user or, e.g.
+// for requests with the POST key, the client address.
+func auditActor(c echo.Context) string {
+	if user := currentUser(c); user != nil {
+		return user.Name
+	}
+	return c.RealIP()
+}
+
+func auditValue(v interface{}) AuditValue {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("audit: marshal error: %v", err)
+		return nil
+	}
+	return b
+}
+
+// recordAudit appends the entry to the audit table
+func recordAudit(tx *gorm.DB, entry *AuditEntry) error {
+	entry.ID = 0
+	entry.Time = Time(time.Now())
+	return tx.Create(entry).Error
+}
+
+// newAuditEntry returns an entry describing the API call
+func newAuditEntry(c echo.Context, entity string, entityId, raceId uint, before, after interface{}) *AuditEntry {
+	return &AuditEntry{
+		Actor:    auditActor(c),
+		Action:   c.Request().Method + " " + c.Path(),
+		Entity:   entity,
+		EntityID: entityId,
+		RaceID:   raceId,
+		Before:   auditValue(before),
+		After:    auditValue(after),
+	}
+}
+
+// audit records the change made by the API call. It should be called
+// after the change is stored. Errors are only logged, because the
+// change itself has already succeeded.
+func audit(c echo.Context, entity string, entityId, raceId uint, before, after interface{}) {
+	c.Set(auditedKey, true)
+	if err := recordAudit(db, newAuditEntry(c, entity, entityId, raceId, before, after)); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// auditTx records the change in the transaction making the change
+func auditTx(tx *gorm.DB, c echo.Context, entity string, entityId, raceId uint, before, after interface{}) error {
+	c.Set(auditedKey, true)
+	return recordAudit(tx, newAuditEntry(c, entity, entityId, raceId, before, after))
+}
+
+// auditMiddleware records successful POST requests, whose handlers do
+// not record the change themselves, so that no change goes unnoticed.
+// Entity of such entries is the route and EntityID its id parameter.
+func auditMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		if c.Request().Method != http.MethodPost || err != nil || c.Response().Status >= 400 || c.Get(auditedKey) != nil {
+			return err
+		}
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		audit(c, c.Path(), uint(id), 0, nil, nil)
+		return err
+	}
+}
+
+// AuditFilter selects audit entries
+type AuditFilter struct {
+	RaceID   uint   `query:"race_id"`
+	Entity   string `query:"entity"`
+	EntityID uint   `query:"entity_id"`
+	Actor    string `query:"actor"`
+}
+
+func getAudit(c echo.Context) error {
+	var filter AuditFilter
+	if err := c.Bind(&filter); err != nil {
+		return err
+	}
+	query := db.Order("id")
+	if filter.RaceID != 0 {
+		query = query.Where("race_id = ?", filter.RaceID)
+	}
+	if filter.Entity != "" {
+		query = query.Where("entity = ?", filter.Entity)
+	}
+	if filter.EntityID != 0 {
+		query = query.Where("entity_id = ?", filter.EntityID)
+	}
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	entries := []AuditEntry{}
+	if err := query.Find(&entries).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, entries)
+}
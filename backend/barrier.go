@@ -4,9 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
 )
 
 const (
@@ -16,8 +20,49 @@ const (
 
 	// Time allowed to read the next pong message from the peer.
 	barrierPongWait = (barrierPingPeriod * 11) / 10
+
+	// Maximum message size allowed from the barrier (batches of
+	// buffered detections can be large).
+	barrierMaxMessageSize = 64 * 1024
+
+	// Time allowed to the existing connection of a barrier to answer a
+	// ping when the barrier connects again (see Hub.run).
+	takeoverPingWait = 2 * time.Second
 )
 
+// BarrierMessage is a message sent by the barrier
+type BarrierMessage struct {
+	// Time of the detection in microseconds since epoch
+	Timestamp int64 `json:"timestamp"`
+	// Optional per-barrier sequence number of the detection. The
+	// server acknowledges stored detections with BarrierAck, so
+	// that barriers can safely resend unacknowledged detections.
+	Seq *uint64 `json:"seq,omitempty"`
+	// Identifier of the barrier boot (random on each start), so that
+	// sequence numbers restarted e.g. after losing the barrier's
+	// state are not taken for duplicates
+	Boot uint64 `json:"boot,omitempty"`
+	// Reply to TimeRequest (the message contains no detection)
+	TimeResponse *TimeResponse `json:"timeResponse,omitempty"`
+	// Detections buffered by the barrier while it was disconnected
+	// (the message contains no detection itself)
+	Batch []BarrierMessage `json:"batch,omitempty"`
+	// Optional identifier of the car, e.g. transponder code. Known
+	// identifiers determine the team of the crossing (see Car).
+	CarId string `json:"carId,omitempty"`
+	// Periodic health status (the message contains no detection)
+	Status *BarrierTelemetry `json:"status,omitempty"`
+}
+
+// BarrierAck acknowledges that the detection with sequence number Ack
+// was stored.
+type BarrierAck struct {
+	Ack        uint64 `json:"ack"`
+	CrossingID uint   `json:"crossingId"`
+	// The detection was already stored before
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
 type Barrier struct {
 	// The websocket connection.
 	conn *websocket.Conn
@@ -26,7 +71,60 @@ type Barrier struct {
 	// Barrier ID
 	Id uint
 
-	RegistrationOk chan bool
+	// Serializes writes of data messages
+	writeMutex sync.Mutex
+
+	// Barrier clock offset estimate
+	clock BarrierClock
+
+	// The last detection had an implausible timestamp
+	clockFault bool
+
+	// Closed to make the pinger close the connection
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	// Closed when the reader stops
+	done chan struct{}
+
+	// Makes the pinger ping the barrier immediately
+	pingNow chan struct{}
+
+	// Signalled when the barrier answers a ping
+	pong chan struct{}
+
+	// Reply of the hub to the registration of the barrier
+	registered chan barrierRegistration
+}
+
+func newBarrier(id uint, hub *Hub) *Barrier {
+	return &Barrier{
+		Id:         id,
+		hub:        hub,
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+		pingNow:    make(chan struct{}),
+		pong:       make(chan struct{}, 1),
+		registered: make(chan barrierRegistration, 1),
+	}
+}
+
+// disconnect closes the connection of the barrier. The reader then
+// unregisters the barrier.
+func (b *Barrier) disconnect() {
+	b.closingOnce.Do(func() { close(b.closing) })
+}
+
+// disconnecting returns true once the barrier is being disconnected.
+// Its detections are not stored then, so that they are not stored
+// concurrently with a connection replacing this one.
+func (b *Barrier) disconnecting() bool {
+	select {
+	case <-b.closing:
+		return true
+	default:
+		return false
+	}
 }
 
 // reader reads messages from the barrier, updates the database and notifies the hub
@@ -34,17 +132,31 @@ func (b *Barrier) reader(conn *websocket.Conn) {
 	b.conn = conn
 
 	go b.pinger()
+	go b.clockSync()
 
 	name := fmt.Sprintf("barrier%d", b.Id)
 	defer func() {
 		log.Println(name + ": closing websocket")
 		b.conn.Close()
 		b.hub.unregisterBarrier <- b
+		close(b.done)
 	}()
-	b.conn.SetReadLimit(maxMessageSize)
+	b.conn.SetReadLimit(barrierMaxMessageSize)
 
 	b.conn.SetReadDeadline(time.Now().Add(barrierPongWait))
-	b.conn.SetPongHandler(func(string) error { b.conn.SetReadDeadline(time.Now().Add(barrierPongWait)); return nil })
+	b.conn.SetPongHandler(func(data string) error {
+		b.conn.SetReadDeadline(time.Now().Add(barrierPongWait))
+		// pings carry the time when they were sent
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			rtt := Duration(time.Since(time.Unix(0, sent)))
+			b.hub.updateBarrierHealth <- BarrierHealthUpdate{BarrierId: b.Id, Rtt: &rtt}
+		}
+		select {
+		case b.pong <- struct{}{}:
+		default:
+		}
+		return nil
+	})
 
 	for {
 		_, message, err := b.conn.ReadMessage()
@@ -52,68 +164,321 @@ func (b *Barrier) reader(conn *websocket.Conn) {
 			log.Printf(name+": %v", err)
 			break
 		}
-		var msg struct {
-			Timestamp int64 `json:"timestamp"`
+		if b.disconnecting() {
+			// unacknowledged detections are resent by the barrier
+			break
 		}
+		var msg BarrierMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
 			log.Printf(name+": message parse error: %v", err)
 			continue
 		}
+		if msg.TimeResponse != nil {
+			b.handleTimeResponse(msg.TimeResponse)
+			continue
+		}
+		if msg.Status != nil {
+			b.hub.updateBarrierHealth <- BarrierHealthUpdate{BarrierId: b.Id, Telemetry: msg.Status}
+			continue
+		}
+		if len(msg.Batch) > 0 {
+			b.replay(msg.Batch)
+			continue
+		}
 		if msg.Timestamp == 0 {
 			log.Printf(name+": missing timestamp in: %v", string(message))
 			continue
 		}
-		var race Race
-		if err := db.Last(&race, "state = ?", Running).Error; err != nil {
+		crossing, duplicate, err := b.storeCrossing(&msg, false)
+		if err != nil {
+			log.Printf(name+": failed to store crossing: %v", err)
+			continue
+		}
+		if !duplicate && crossing.RaceID != 0 {
+			broadcastRace(&Race{CommonModelFields: CommonModelFields{ID: crossing.RaceID}})
+		}
+		if msg.Seq != nil {
+			b.send(&BarrierAck{Ack: *msg.Seq, CrossingID: crossing.ID, Duplicate: duplicate})
+		}
+	}
+}
+
+// replay stores detections buffered by the barrier while the backend
+// was unreachable. They are stored in timestamp order and associated
+// with the race that was running at the time of each detection.
+// Each affected race is broadcast only once.
+func (b *Barrier) replay(batch []BarrierMessage) {
+	name := fmt.Sprintf("barrier%d", b.Id)
+	log.Printf(name+": replaying %d buffered detections", len(batch))
+	sort.SliceStable(batch, func(i, j int) bool { return batch[i].Timestamp < batch[j].Timestamp })
+	races := make(map[uint]bool)
+	for i := range batch {
+		msg := &batch[i]
+		if b.disconnecting() {
+			break
+		}
+		if msg.Timestamp == 0 {
+			log.Printf(name + ": missing timestamp in buffered detection")
+			continue
+		}
+		crossing, duplicate, err := b.storeCrossing(msg, true)
+		if err != nil {
+			log.Printf(name+": failed to store buffered crossing: %v", err)
+			continue
+		}
+		if !duplicate && crossing.RaceID != 0 {
+			races[crossing.RaceID] = true
+		}
+		if msg.Seq != nil {
+			b.send(&BarrierAck{Ack: *msg.Seq, CrossingID: crossing.ID, Duplicate: duplicate})
+		}
+	}
+	for raceId := range races {
+		broadcastRace(&Race{CommonModelFields: CommonModelFields{ID: raceId}})
+	}
+}
+
+// raceAt returns the race which was running on the barrier's track at
+// time t. race.ID is 0 if there was no such race.
+func raceAt(barrierId uint, t time.Time, race *Race) error {
+	var races []Race
+	err := db.Preload("Track.Barriers").Preload("Pauses").
+		Where("started_at <= ? AND (stopped_at IS NULL OR stopped_at >= ?)", t, t).
+		Order("started_at DESC").Find(&races).Error
+	if err != nil {
+		return err
+	}
+	for i := range races {
+		if races[i].track().barrier(barrierId) != nil {
+			*race = races[i]
+			return nil
+		}
+	}
+	return nil
+}
+
+// findDuplicate returns the already stored crossing of the detection
+// (see storeCrossing). crossing.ID is 0 if there is no such crossing.
+func (b *Barrier) findDuplicate(msg *BarrierMessage, rawTs Time, replayed bool) (crossing Crossing, err error) {
+	if msg.Seq != nil {
+		err = db.Where("barrier_id = ? AND boot = ? AND seq = ?", b.Id, msg.Boot, *msg.Seq).Limit(1).Find(&crossing).Error
+	} else if replayed {
+		err = db.Where("barrier_id = ? AND raw_time = ?", b.Id, rawTs).Limit(1).Find(&crossing).Error
+	}
+	if err == nil && crossing.ID == 0 {
+		// detections of grouped barriers are stored separately
+		crossing, err = fusedDuplicate(b.Id, msg.Boot, msg.Seq, rawTs, replayed)
+	}
+	return
+}
+
+// storeCrossing stores the crossing reported by the barrier and
+// associates it with the race running on the barrier's track. If
+// replayed is true, the crossing was buffered by the barrier and it is
+// associated with the race running at the time of the crossing rather
+// than with the current race. Crossings with a sequence number (per
+// barrier boot) or replayed crossings with the same barrier timestamp
+// are stored only once; for already stored crossings, the original
+// crossing is returned with duplicate set to true. The caller
+// broadcasts the race.
+func (b *Barrier) storeCrossing(msg *BarrierMessage, replayed bool) (crossing Crossing, duplicate bool, err error) {
+	name := fmt.Sprintf("barrier%d", b.Id)
+	rawTs := Time(time.UnixMicro(msg.Timestamp))
+	if crossing, err = b.findDuplicate(msg, rawTs, replayed); err != nil {
+		return
+	}
+	defer func() {
+		// The same detection stored concurrently (e.g. by the reader
+		// of a replaced connection) violates the unique index.
+		if err == nil || duplicate {
+			return
+		}
+		if dup, dupErr := b.findDuplicate(msg, rawTs, replayed); dupErr == nil && dup.ID != 0 {
+			log.Printf(name+": crossing seq=%v stored concurrently", msg.Seq)
+			crossing, duplicate, err = dup, true, nil
+		}
+	}()
+	// A live detection delayed in the network can be quarantined
+	// while its replay is plausible. It is stored again then.
+	var quarantined Crossing
+	if crossing.ID != 0 && crossing.ClockFault != NoClockFault && replayed {
+		quarantined, crossing = crossing, Crossing{}
+	}
+	if crossing.ID != 0 {
+		log.Printf(name+": duplicate crossing seq=%v at %v", msg.Seq, time.Time(rawTs))
+		return crossing, true, nil
+	}
+	// barrier time corrected by the estimated clock offset
+	ts := Time(b.clock.correct(time.Time(rawTs)))
+	now := time.Now()
+	fault, err := b.checkTimestamp(time.Time(ts), now, replayed)
+	if err != nil {
+		return
+	}
+	b.reportClockFault(fault, time.Time(ts), now)
+	if quarantined.ID != 0 {
+		if fault != NoClockFault {
+			log.Printf(name+": duplicate quarantined crossing seq=%v at %v", msg.Seq, time.Time(rawTs))
+			return quarantined, true, nil
+		}
+		log.Printf(name+": releasing quarantined crossing %d", quarantined.ID)
+		// the sequence number is unique
+		if err = db.Delete(&quarantined).Error; err != nil {
+			return
+		}
+	}
+	if fault != NoClockFault {
+		// quarantined crossings are not associated with any race
+		crossing = Crossing{
+			Time:       ts,
+			RawTime:    &rawTs,
+			BarrierId:  b.Id,
+			Boot:       msg.Boot,
+			Seq:        msg.Seq,
+			CarId:      msg.CarId,
+			ClockFault: fault,
+		}
+		err = db.Create(&crossing).Error
+		return
+	}
+	var race Race
+	paused := false
+	if replayed {
+		if err := raceAt(b.Id, time.Time(ts), &race); err != nil {
+			log.Printf(name+": error obtaining race at %v: %v", time.Time(ts), err)
+		}
+		paused = race.ID != 0 && pausedAt(race.Pauses, time.Time(ts))
+	} else if raceId := currentRaces.forBarrier(b.Id); raceId != 0 {
+		// the race running on the track of this barrier
+		if err := db.Preload("Track.Barriers").Preload("Pauses").First(&race, raceId).Error; err != nil {
 			log.Printf(name+": error obtaining running race: %v", err)
 		}
-		ts := Time(time.UnixMicro(msg.Timestamp))
-		log.Printf(name+": adding new crossing for race %d at %v", race.ID, time.Time(ts))
-		crossing := Crossing{
-			Time:      ts,
-			Ignored:   false,
-			BarrierId: b.Id,
-		}
-		if race.ID != 0 {
-			if race.Type == HeadToHead {
-				// Switch crossing teams in round robin fashion. If needed, barrier operators
-				// can correct the team associated with the crossing via the frontend.
-				var lastCrossing Crossing
-				var crossingCnt int64
-				filter := Crossing{RaceID: race.ID, BarrierId: b.Id, Ignored: false}
-				db.Model(&Crossing{}).Where(&filter).Where("ignored = ?", false).Count(&crossingCnt)
-				if err := db.Where(&filter).Where("ignored = ?", false).Last(&lastCrossing).Error; err != nil {
-					// First crossing in a race
-					if crossing.BarrierId == 1 {
-						crossing.Team = TeamA
-					} else if crossing.BarrierId == 2 {
-						crossing.Team = TeamB
-					}
-				} else {
-					if crossingCnt == 1 && (time.Time(crossing.Time).Sub(time.Time(lastCrossing.Time)).Milliseconds() < 1000) {
-						crossing.Ignored = true
-					}
-					// Later crossings in the race
-					if lastCrossing.Team == TeamA {
-						crossing.Team = TeamB
-					} else if lastCrossing.Team == TeamB {
-						crossing.Team = TeamA
-					}
-				}
-				log.Printf(name+": associating crossing with team %d", crossing.Team)
-			}
-			// this also updates Race's UpdatedAt which is what we want
-			// so the frontend can find out what is the latest version
-			if err := db.Model(&race).Association("Crossings").Append(&crossing); err != nil {
-				log.Printf(name+": failed to append crossing: %v", err)
-				continue
-			}
-			broadcastRace(&race)
-		} else {
-			if err := db.Create(&crossing).Error; err != nil {
-				log.Printf(name+": failed to crate crossing: %v", err)
-			}
+		paused = race.State == Paused
+	}
+	// Detections of grouped barriers are merged into logical
+	// crossings of the group's main barrier.
+	var detection *Detection
+	crossingBarrier, crossingBoot, crossingSeq := b.Id, msg.Boot, msg.Seq
+	if group := race.track().group(b.Id); race.ID != 0 && group != 0 {
+		// sensors of the group have their own readers
+		defer lockGroups(group)()
+		detection = &Detection{BarrierId: b.Id, Boot: msg.Boot, Seq: msg.Seq, Time: ts, RawTime: &rawTs}
+		if crossing, err = fusedCrossing(db, &race, group, b.Id, ts); err != nil {
+			return
 		}
+		if crossing.ID != 0 {
+			log.Printf(name+": merging detection into crossing %d of barrier %d", crossing.ID, group)
+			detection.CrossingID = crossing.ID
+			err = db.Create(detection).Error
+			return
+		}
+		crossingBarrier, crossingBoot, crossingSeq = group, 0, nil
+	}
+	log.Printf(name+": adding new crossing for race %d at %v", race.ID, time.Time(ts))
+	crossing = Crossing{
+		Time:      ts,
+		RawTime:   &rawTs,
+		Ignored:   false,
+		BarrierId: crossingBarrier,
+		Boot:      crossingBoot,
+		Seq:       crossingSeq,
+		CarId:     msg.CarId,
+		Paused:    paused,
+	}
+	if race.StartedAt != nil && time.Time(ts).Before(time.Time(*race.StartedAt)) {
+		log.Printf(name+": false start in race %d", race.ID)
+		crossing.FalseStart = true
+	}
+	if race.ID == 0 {
+		err = db.Create(&crossing).Error
+		return
+	}
+	if race.Type == HeadToHead {
+		// If needed, barrier operators can correct the team
+		// associated with the crossing via the frontend.
+		if crossing.Team, err = race.teamAssigner().assignTeam(db, &race, &crossing); err != nil {
+			return
+		}
+	}
+	if crossing.CarId != "" {
+		// the identified car takes precedence over the heuristic
+		if err = assignCarTeam(db, &race, &crossing); err != nil {
+			return
+		}
+		if crossing.TeamMismatch {
+			log.Printf(name+": car %s disagrees with the assigned team", crossing.CarId)
+		}
+	}
+	if race.Type == HeadToHead {
+		log.Printf(name+": associating crossing with team %d", crossing.Team)
+	}
+	// Filter out noise such as a person's leg triggering the barrier
+	// twice. Operators can unignore such crossings.
+	if crossing.IgnoreReason, err = autoIgnoreReason(db, &race, &crossing); err != nil {
+		return
+	}
+	if crossing.IgnoreReason != NotIgnored {
+		log.Printf(name+": ignoring crossing (%s)", crossing.IgnoreReason)
+		crossing.Ignored = true
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// this also updates Race's UpdatedAt which is what we want
+		// so the frontend can find out what is the latest version
+		if err := tx.Model(&race).Association("Crossings").Append(&crossing); err != nil {
+			return err
+		}
+		if detection == nil {
+			return nil
+		}
+		detection.CrossingID = crossing.ID
+		return tx.Create(detection).Error
+	})
+	if err != nil {
+		return
+	}
+	if crossing.FalseStart {
+		if err := updateFalseStarts(db, race.ID); err != nil {
+			log.Printf(name+": failed to update false starts: %v", err)
+		}
+	}
+	return
+}
+
+// send sends a JSON message to the barrier
+func (b *Barrier) send(v interface{}) error {
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	b.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	err := b.conn.WriteJSON(v)
+	if err != nil {
+		log.Printf("barrier%d: write error: %v", b.Id, err)
+	}
+	return err
+}
+
+// answersPing pings the barrier and returns true if it answers within
+// takeoverPingWait, i.e. the connection is not stale.
+func (b *Barrier) answersPing() bool {
+	timeout := time.After(takeoverPingWait)
+	// an answer to an earlier ping does not count
+	select {
+	case <-b.pong:
+	default:
+	}
+	select {
+	case b.pingNow <- struct{}{}:
+	case <-b.done:
+		return false
+	case <-timeout:
+		return false
+	}
+	select {
+	case <-b.pong:
+		return true
+	case <-b.done:
+		return false
+	case <-timeout:
+		return false
 	}
 }
 
@@ -124,9 +489,19 @@ func (b *Barrier) pinger() {
 		b.conn.Close()
 	}()
 	for {
-		<-ticker.C
-		b.conn.SetWriteDeadline(time.Now().Add(writeWait))
-		if err := b.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+		select {
+		case <-ticker.C:
+		case <-b.pingNow:
+		case <-b.closing:
+			msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "disconnected by the server")
+			b.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			return
+		}
+		// the pong handler measures the round-trip time
+		ping := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+		// WriteControl can be called concurrently with writes of
+		// the reader
+		if err := b.conn.WriteControl(websocket.PingMessage, ping, time.Now().Add(writeWait)); err != nil {
 			return
 		}
 	}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testMessage returns a detection d after start
+func testMessage(start time.Time, d time.Duration, boot uint64, seq *uint64) *BarrierMessage {
+	return &BarrierMessage{Timestamp: start.Add(d).UnixMicro(), Boot: boot, Seq: seq}
+}
+
+func seqPtr(seq uint64) *uint64 {
+	return &seq
+}
+
+func countCrossings(t *testing.T) int64 {
+	t.Helper()
+	var n int64
+	if err := db.Model(&Crossing{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestStoreCrossingDeduplicatesBySeq(t *testing.T) {
+	setupTestDb(t)
+	now := time.Now()
+	b := &Barrier{Id: 1, hub: hub}
+	first, duplicate, err := b.storeCrossing(testMessage(now, 0, 7, seqPtr(1)), false)
+	if err != nil || duplicate {
+		t.Fatalf("storeCrossing() = %v, %v, want stored crossing", duplicate, err)
+	}
+	// the barrier resends the detection, e.g. after a lost ack
+	again, duplicate, err := b.storeCrossing(testMessage(now, 0, 7, seqPtr(1)), false)
+	if err != nil || !duplicate || again.ID != first.ID {
+		t.Errorf("resent detection: crossing %d, duplicate = %v, err = %v, want crossing %d, duplicate",
+			again.ID, duplicate, err, first.ID)
+	}
+	// the same sequence number of another boot or barrier is a new detection
+	if _, duplicate, err := b.storeCrossing(testMessage(now, time.Second, 8, seqPtr(1)), false); err != nil || duplicate {
+		t.Errorf("other boot: duplicate = %v, err = %v", duplicate, err)
+	}
+	other := &Barrier{Id: 2, hub: hub}
+	if _, duplicate, err := other.storeCrossing(testMessage(now, time.Second, 7, seqPtr(1)), false); err != nil || duplicate {
+		t.Errorf("other barrier: duplicate = %v, err = %v", duplicate, err)
+	}
+	// detections without sequence number are never duplicates
+	for i := 0; i < 2; i++ {
+		if _, duplicate, err := b.storeCrossing(testMessage(now, 2*time.Second, 0, nil), false); err != nil || duplicate {
+			t.Errorf("no seq: duplicate = %v, err = %v", duplicate, err)
+		}
+	}
+	if n := countCrossings(t); n != 5 {
+		t.Errorf("%d crossings stored, want 5", n)
+	}
+}
+
+func TestStoreCrossingRunningRace(t *testing.T) {
+	setupTestDb(t)
+	race := Race{Type: TimeTrial}
+	startTestRace(t, &race)
+	now := time.Now()
+	b := &Barrier{Id: 1, hub: hub}
+	crossing, _, err := b.storeCrossing(testMessage(now, 0, 7, seqPtr(1)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crossing.RaceID != race.ID {
+		t.Errorf("crossing of race %d, want %d", crossing.RaceID, race.ID)
+	}
+	// a resent detection is not added to the race again
+	if _, _, err := b.storeCrossing(testMessage(now, 0, 7, seqPtr(1)), false); err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	db.Model(&Crossing{}).Where("race_id = ?", race.ID).Count(&n)
+	if n != 1 {
+		t.Errorf("%d crossings in race, want 1", n)
+	}
+}
+
+func TestStoreCrossingReplayed(t *testing.T) {
+	setupTestDb(t)
+	start := time.Now().Add(-10 * time.Minute)
+	startedAt, stoppedAt := Time(start), Time(start.Add(time.Minute))
+	pauseEnd := Time(start.Add(30 * time.Second))
+	past := Race{
+		Type:      TimeTrial,
+		State:     Finished,
+		StartedAt: &startedAt,
+		StoppedAt: &stoppedAt,
+		Pauses:    []RacePause{{StartTime: Time(start.Add(20 * time.Second)), EndTime: &pauseEnd}},
+	}
+	if err := db.Create(&past).Error; err != nil {
+		t.Fatal(err)
+	}
+	// the current race must not get the buffered detections
+	startTestRace(t, &Race{Type: TimeTrial})
+	b := &Barrier{Id: 1, hub: hub}
+	tests := []struct {
+		name   string
+		d      time.Duration
+		raceId uint
+		paused bool
+	}{
+		{"during the race", 10 * time.Second, past.ID, false},
+		{"during the pause", 25 * time.Second, past.ID, true},
+		{"after the race", 2 * time.Minute, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crossing, duplicate, err := b.storeCrossing(testMessage(start, tt.d, 0, nil), true)
+			if err != nil || duplicate {
+				t.Fatalf("storeCrossing() = %v, %v, want stored crossing", duplicate, err)
+			}
+			if crossing.RaceID != tt.raceId || crossing.Paused != tt.paused {
+				t.Errorf("crossing of race %d (paused %v), want race %d (paused %v)",
+					crossing.RaceID, crossing.Paused, tt.raceId, tt.paused)
+			}
+			// barriers without sequence numbers may replay the
+			// same batch again
+			again, duplicate, err := b.storeCrossing(testMessage(start, tt.d, 0, nil), true)
+			if err != nil || !duplicate || again.ID != crossing.ID {
+				t.Errorf("replayed again: crossing %d, duplicate = %v, err = %v, want crossing %d, duplicate",
+					again.ID, duplicate, err, crossing.ID)
+			}
+		})
+	}
+}
+
+func TestStoreCrossingQuarantine(t *testing.T) {
+	tests := []struct {
+		name      string
+		d         time.Duration
+		replayed  bool
+		tolerance time.Duration
+		want      ClockFault
+	}{
+		{"plausible", -time.Second, false, 0, NoClockFault},
+		{"future", time.Minute, false, 0, FutureTimestamp},
+		{"too old", -time.Minute, false, 0, OldTimestamp},
+		{"barrier tolerance", -time.Minute, false, 2 * time.Minute, NoClockFault},
+		{"replayed", -time.Hour, true, 0, NoClockFault},
+		{"replayed future", time.Minute, true, 0, FutureTimestamp},
+		{"replayed too old", -2 * maxReplayAge, true, 0, OldTimestamp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDb(t)
+			if tt.tolerance != 0 {
+				barrier := RegisteredBarrier{CommonModelFields: CommonModelFields{ID: 1}, TimeTolerance: durationPtr(tt.tolerance)}
+				if err := db.Create(&barrier).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			race := Race{Type: TimeTrial}
+			startTestRace(t, &race)
+			b := &Barrier{Id: 1, hub: hub}
+			crossing, _, err := b.storeCrossing(testMessage(time.Now(), tt.d, 0, seqPtr(1)), tt.replayed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if crossing.ClockFault != tt.want {
+				t.Errorf("clockFault = %q, want %q", crossing.ClockFault, tt.want)
+			}
+			// quarantined crossings are not associated with any race
+			// and replayed ones only with a race at their time
+			var wantRace uint
+			if tt.want == NoClockFault && !tt.replayed {
+				wantRace = race.ID
+			}
+			if crossing.RaceID != wantRace {
+				t.Errorf("crossing of race %d, want %d", crossing.RaceID, wantRace)
+			}
+			if b.clockFault != (tt.want != NoClockFault) {
+				t.Errorf("barrier clockFault = %v", b.clockFault)
+			}
+		})
+	}
+}
+
+func TestStoreCrossingQuarantinedReplay(t *testing.T) {
+	setupTestDb(t)
+	b := &Barrier{Id: 1, hub: hub}
+	// a live detection delayed in the network is quarantined
+	msg := testMessage(time.Now(), -time.Minute, 7, seqPtr(1))
+	quarantined, _, err := b.storeCrossing(msg, false)
+	if err != nil || quarantined.ClockFault != OldTimestamp {
+		t.Fatalf("storeCrossing() = %+v, %v, want quarantined crossing", quarantined, err)
+	}
+	// resent live, it is still a quarantined duplicate
+	again, duplicate, err := b.storeCrossing(msg, false)
+	if err != nil || !duplicate || again.ID != quarantined.ID {
+		t.Errorf("resent detection: crossing %d, duplicate = %v, err = %v, want crossing %d, duplicate",
+			again.ID, duplicate, err, quarantined.ID)
+	}
+	// its replay is plausible and replaces the quarantined crossing
+	replayed, duplicate, err := b.storeCrossing(msg, true)
+	if err != nil || duplicate || replayed.ClockFault != NoClockFault {
+		t.Fatalf("replayed detection: %+v, duplicate = %v, err = %v, want plausible crossing", replayed, duplicate, err)
+	}
+	if n := countCrossings(t); n != 1 {
+		t.Errorf("%d crossings stored, want 1", n)
+	}
+	if b.clockFault {
+		t.Errorf("barrier clockFault not cleared")
+	}
+}
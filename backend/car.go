@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Car maps an identifier reported by barriers (e.g. RFID/IR
+// transponder code or a marker decoded by a camera) to a team.
+type Car struct {
+	CommonModelFields
+	CarId  string `gorm:"uniqueIndex" json:"carId"`
+	TeamID uint   `json:"teamId"`
+	Team   Team   `json:"team"`
+}
+
+// carTeamID returns ID of the team the identified car belongs to or 0
+// if the identifier is unknown.
+func carTeamID(tx *gorm.DB, carId string) (uint, error) {
+	var car Car
+	err := tx.Where("car_id = ?", carId).Limit(1).Find(&car).Error
+	return car.TeamID, err
+}
+
+// assignCarTeam assigns the crossing to the team of the identified car
+// instead of the team assigned by the heuristic. If they disagree or
+// the car does not belong to any team of the race, the crossing is
+// flagged with TeamMismatch so that operators can check it.
+func assignCarTeam(tx *gorm.DB, race *Race, crossing *Crossing) error {
+	teamId, err := carTeamID(tx, crossing.CarId)
+	if err != nil || teamId == 0 {
+		return err
+	}
+	var team CrossingTeam
+	switch {
+	case teamId == race.TeamAID:
+		team = TeamA
+	case race.TeamBID != nil && teamId == uint(*race.TeamBID):
+		team = TeamB
+	default:
+		// keep the heuristic team
+		crossing.TeamMismatch = true
+		return nil
+	}
+	if race.Type != HeadToHead {
+		team = TeamNotSet
+	}
+	crossing.TeamMismatch = team != crossing.Team
+	crossing.Team = team
+	return nil
+}
+
+func (car *Car) validate() error {
+	if car.CarId == "" {
+		return fmt.Errorf("carId not specified")
+	}
+	var team Team
+	if err := db.Limit(1).Find(&team, car.TeamID).Error; err != nil {
+		return err
+	}
+	if team.ID == 0 {
+		return fmt.Errorf("no team with id %d", car.TeamID)
+	}
+	return nil
+}
+
+func findCar(id uint, car *Car) error {
+	if err := db.Preload("Team").First(car, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(
+				http.StatusNotFound,
+				fmt.Sprintf("car with id %d not found", id),
+			)
+		}
+		return err
+	}
+	return nil
+}
+
+func getAllCars(c echo.Context) error {
+	var cars []Car
+	if err := db.Preload("Team").Find(&cars).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, cars)
+}
+
+func createCar(c echo.Context) error {
+	var car Car
+	if err := c.Bind(&car); err != nil {
+		return err
+	}
+	if err := car.validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := db.Omit("Team").Create(&car).Error; err != nil {
+		return err
+	}
+	if err := findCar(car.ID, &car); err != nil {
+		return err
+	}
+	audit(c, "car", car.ID, 0, nil, car)
+	return c.JSON(http.StatusOK, car)
+}
+
+func updateCar(c echo.Context) error {
+	var car Car
+	if err := c.Bind(&car); err != nil {
+		return err
+	}
+	var old Car
+	if err := findCar(car.ID, &old); err != nil {
+		return err
+	}
+	if err := car.validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	before := old
+	if err := db.Model(&old).Omit("Team").Select("CarId", "TeamID").Updates(&car).Error; err != nil {
+		return err
+	}
+	if err := findCar(car.ID, &car); err != nil {
+		return err
+	}
+	audit(c, "car", car.ID, 0, before, car)
+	return c.JSON(http.StatusOK, car)
+}
+
+func deleteCar(c echo.Context) error {
+	var car Car
+	if err := c.Bind(&car); err != nil {
+		return err
+	}
+	if err := findCar(car.ID, &car); err != nil {
+		return err
+	}
+	if err := db.Delete(&car).Error; err != nil {
+		return err
+	}
+	audit(c, "car", car.ID, 0, car, nil)
+	return c.JSON(http.StatusOK, car)
+}
@@ -5,7 +5,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
@@ -48,6 +47,9 @@ type Client struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// Event watched by the client, 0 means all events.
+	eventId uint
 }
 
 // writePump pumps messages from the hub to the websocket connection.
@@ -98,11 +100,15 @@ func (c *Client) writePump() {
 
 // Handles websocket requests from the peer.
 func websockHandler(c echo.Context, hub *Hub) error {
+	var eventId uint
+	if err := echo.QueryParamsBinder(c).Uint("event_id", &eventId).BindError(); err != nil {
+		return err
+	}
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
 	}
-	client := &Client{hub: hub, conn: ws, send: make(chan []byte, 256)}
+	client := &Client{hub: hub, conn: ws, send: make(chan []byte, 256), eventId: eventId}
 	client.hub.registerClient <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -111,10 +117,11 @@ func websockHandler(c echo.Context, hub *Hub) error {
 	//go client.readPump()
 
 	{
-		// Inform the newly connected client about current race
-		currentRace.mutex.Lock()
-		b, err := json.Marshal(&currentRace)
-		currentRace.mutex.Unlock()
+		// Inform the newly connected client about current races
+		currentRaces.mutex.Lock()
+		refs := currentRaces.snapshot()
+		currentRaces.mutex.Unlock()
+		b, err := currentRacesMessage(refs, eventId)
 		if err != nil {
 			return fmt.Errorf("initial current race marshall error: %v", err)
 		}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the backend measures the barrier clock offset
+	clockSyncPeriod = 5 * time.Second
+
+	// Number of recent measurements used to estimate the offset
+	clockSamples = 8
+)
+
+// Maximum clock offset of barriers tolerated without warning operators
+var maxClockOffset = 20 * time.Millisecond
+
+// TimeRequest is sent by the backend to the barrier. The barrier
+// replies with TimeResponse containing T0 and its own time.
+type TimeRequest struct {
+	// Backend time in microseconds since epoch
+	T0 int64 `json:"t0"`
+}
+
+// TimeResponse is the barrier's reply to TimeRequest.
+type TimeResponse struct {
+	T0 int64 `json:"t0"`
+	// Barrier time when the request was received (microseconds)
+	T1 int64 `json:"t1"`
+	// Barrier time when the response was sent (microseconds). If
+	// zero, T1 is used.
+	T2 int64 `json:"t2,omitempty"`
+}
+
+type clockSample struct {
+	offset time.Duration
+	rtt    time.Duration
+}
+
+// BarrierClock estimates the offset of the barrier clock from the
+// backend clock in the same way as NTP does.
+type BarrierClock struct {
+	mutex   sync.Mutex
+	samples []clockSample
+	// Estimated barrier time minus backend time
+	offset time.Duration
+	// Round-trip time of the sample used for the estimate
+	rtt     time.Duration
+	valid   bool
+	warning bool
+}
+
+// BarrierClockStatus is sent to operators
+type BarrierClockStatus struct {
+	BarrierId uint     `json:"barrierId"`
+	Offset    Duration `json:"offset"`
+	Rtt       Duration `json:"rtt"`
+	// The offset is above the tolerated maximum
+	Warning bool `json:"warning"`
+}
+
+// addSample adds the measurement and updates the estimate. t3 is the
+// backend time when the response was received. It returns true when
+// the warning state changed.
+func (c *BarrierClock) addSample(resp *TimeResponse, t3 time.Time) bool {
+	t2 := resp.T2
+	if t2 == 0 {
+		t2 = resp.T1
+	}
+	t0 := time.UnixMicro(resp.T0)
+	t1 := time.UnixMicro(resp.T1)
+	sample := clockSample{
+		offset: (t1.Sub(t0) + time.UnixMicro(t2).Sub(t3)) / 2,
+		rtt:    t3.Sub(t0) - time.UnixMicro(t2).Sub(t1),
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.samples = append(c.samples, sample)
+	if len(c.samples) > clockSamples {
+		c.samples = c.samples[1:]
+	}
+	// The sample with the lowest round-trip time is the most accurate
+	best := c.samples[0]
+	for _, s := range c.samples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	c.offset, c.rtt, c.valid = best.offset, best.rtt, true
+	warning := c.offset > maxClockOffset || c.offset < -maxClockOffset
+	changed := warning != c.warning
+	c.warning = warning
+	return changed
+}
+
+// correct converts barrier time to backend time
+func (c *BarrierClock) correct(t time.Time) time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.valid {
+		return t
+	}
+	return t.Add(-c.offset)
+}
+
+func (c *BarrierClock) status(barrierId uint) BarrierClockStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return BarrierClockStatus{
+		BarrierId: barrierId,
+		Offset:    Duration(c.offset),
+		Rtt:       Duration(c.rtt),
+		Warning:   c.warning,
+	}
+}
+
+// clockSync periodically asks the barrier for its time
+func (b *Barrier) clockSync() {
+	ticker := time.NewTicker(clockSyncPeriod)
+	defer ticker.Stop()
+	for {
+		var msg struct {
+			TimeRequest TimeRequest `json:"timeRequest"`
+		}
+		msg.TimeRequest.T0 = time.Now().UnixMicro()
+		if err := b.send(&msg); err != nil {
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// handleTimeResponse updates the clock estimate and warns operators
+// when the offset exceeds maxClockOffset.
+func (b *Barrier) handleTimeResponse(resp *TimeResponse) {
+	if !b.clock.addSample(resp, time.Now()) {
+		return
+	}
+	status := b.clock.status(b.Id)
+	if status.Warning {
+		log.Printf("barrier%d: clock offset %v exceeds %v", b.Id, time.Duration(status.Offset), maxClockOffset)
+	} else {
+		log.Printf("barrier%d: clock offset %v is OK", b.Id, time.Duration(status.Offset))
+	}
+	hub.sendJSON(&struct {
+		BarrierClock BarrierClockStatus `json:"barrierClock"`
+	}{status})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testTimeSample is a clock measurement: the backend sends the request
+// at t0 and receives the response at t3, the barrier receives it at t1
+// and replies at t2 (all relative to testStart)
+type testTimeSample struct {
+	t0, t1, t2, t3 time.Duration
+}
+
+func (s testTimeSample) response() *TimeResponse {
+	resp := &TimeResponse{T0: at(s.t0).UnixMicro(), T1: at(s.t1).UnixMicro()}
+	if s.t2 != 0 {
+		resp.T2 = at(s.t2).UnixMicro()
+	}
+	return resp
+}
+
+func TestBarrierClock(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		samples []testTimeSample
+		offset  time.Duration
+		rtt     time.Duration
+		warning bool
+		// addSample result for the last sample
+		changed bool
+	}{
+		{
+			name:    "synchronized",
+			samples: []testTimeSample{{0, 5 * ms, 6 * ms, 11 * ms}},
+			offset:  0, rtt: 10 * ms,
+		},
+		{
+			name:    "barrier ahead",
+			samples: []testTimeSample{{0, 35 * ms, 36 * ms, 11 * ms}},
+			offset:  30 * ms, rtt: 10 * ms, warning: true, changed: true,
+		},
+		{
+			name:    "barrier behind",
+			samples: []testTimeSample{{100 * ms, 75 * ms, 75 * ms, 110 * ms}},
+			offset:  -30 * ms, rtt: 10 * ms, warning: true, changed: true,
+		},
+		{
+			name:    "no reply time",
+			samples: []testTimeSample{{0, 15 * ms, 0, 10 * ms}},
+			offset:  10 * ms, rtt: 10 * ms,
+		},
+		{
+			name: "lowest round-trip time wins",
+			samples: []testTimeSample{
+				{0, 40 * ms, 40 * ms, 60 * ms},
+				{100 * ms, 102 * ms, 102 * ms, 104 * ms},
+				{200 * ms, 230 * ms, 230 * ms, 220 * ms},
+			},
+			offset: 0, rtt: 4 * ms,
+		},
+		{
+			name: "warning cleared",
+			samples: []testTimeSample{
+				{0, 35 * ms, 35 * ms, 10 * ms},
+				{100 * ms, 101 * ms, 101 * ms, 102 * ms},
+			},
+			offset: 0, rtt: 2 * ms, changed: true,
+		},
+		{
+			name: "warning kept",
+			samples: []testTimeSample{
+				{0, 35 * ms, 35 * ms, 10 * ms},
+				{100 * ms, 130 * ms, 130 * ms, 120 * ms},
+			},
+			offset: 30 * ms, rtt: 10 * ms, warning: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var clock BarrierClock
+			var changed bool
+			for _, s := range tt.samples {
+				changed = clock.addSample(s.response(), at(s.t3))
+			}
+			status := clock.status(1)
+			if time.Duration(status.Offset) != tt.offset {
+				t.Errorf("offset = %v, want %v", time.Duration(status.Offset), tt.offset)
+			}
+			if time.Duration(status.Rtt) != tt.rtt {
+				t.Errorf("rtt = %v, want %v", time.Duration(status.Rtt), tt.rtt)
+			}
+			if status.Warning != tt.warning {
+				t.Errorf("warning = %v, want %v", status.Warning, tt.warning)
+			}
+			if changed != tt.changed {
+				t.Errorf("addSample() = %v, want %v", changed, tt.changed)
+			}
+			if got := clock.correct(at(time.Second)); !got.Equal(at(time.Second - tt.offset)) {
+				t.Errorf("correct() = %v, want %v", got.Sub(testStart), time.Second-tt.offset)
+			}
+		})
+	}
+}
+
+func TestBarrierClockOldestSampleDropped(t *testing.T) {
+	var clock BarrierClock
+	// the first sample is the most accurate until it is dropped
+	clock.addSample(testTimeSample{0, time.Microsecond, time.Microsecond, 2 * time.Microsecond}.response(), at(2*time.Microsecond))
+	for i := 0; i < clockSamples; i++ {
+		s := testTimeSample{time.Duration(i+1) * time.Second, 0, 0, 0}
+		s.t1 = s.t0 + 15*time.Millisecond
+		s.t3 = s.t0 + 10*time.Millisecond
+		clock.addSample(s.response(), at(s.t3))
+	}
+	if offset := time.Duration(clock.status(1).Offset); offset != 10*time.Millisecond {
+		t.Errorf("offset = %v, want %v", offset, 10*time.Millisecond)
+	}
+}
+
+func TestBarrierClockNotSynchronized(t *testing.T) {
+	var clock BarrierClock
+	if got := clock.correct(at(time.Second)); !got.Equal(at(time.Second)) {
+		t.Errorf("correct() = %v, want %v", got.Sub(testStart), time.Second)
+	}
+}
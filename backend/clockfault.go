@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Crossings whose (corrected) timestamp is implausible, e.g. because
+// the barrier booted without RTC and its clock was not synchronized
+// yet, are quarantined: they are stored with ClockFault set, but not
+// associated with any race. Operators can release them (optionally
+// correcting the timestamp) and attach them to a race as orphaned
+// crossings.
+
+// ClockFault tells why the crossing timestamp was rejected
+type ClockFault string
+
+const (
+	NoClockFault ClockFault = ""
+	// The timestamp is ahead of the backend time
+	FutureTimestamp ClockFault = "future"
+	// The timestamp is older than the detection could be
+	OldTimestamp ClockFault = "too_old"
+)
+
+// Default maximum difference between the timestamp of a detection and
+// the backend time when it is received. Barriers can override it (see
+// RegisteredBarrier).
+var timeTolerance = 5 * time.Second
+
+// Detections buffered by the barrier (see Barrier.replay) can be older
+// than the tolerance, but not older than this.
+const maxReplayAge = 24 * time.Hour
+
+// SQL interface
+
+func (e *ClockFault) Scan(value interface{}) error {
+	s, _ := value.(string)
+	*e = ClockFault(s)
+	return nil
+}
+
+func (e ClockFault) Value() (driver.Value, error) {
+	return string(e), nil
+}
+
+// BarrierClockFault is sent to operators when the barrier sends an
+// implausible timestamp and again (with Fault false) when it sends a
+// plausible one.
+type BarrierClockFault struct {
+	BarrierId uint       `json:"barrierId"`
+	Fault     bool       `json:"fault"`
+	Reason    ClockFault `json:"reason,omitempty"`
+	// Backend time when the detection was received and the
+	// (corrected) timestamp of the detection
+	Time      Time `json:"time"`
+	Timestamp Time `json:"timestamp"`
+}
+
+// notQuarantined selects crossings with plausible timestamps
+func notQuarantined(tx *gorm.DB) *gorm.DB {
+	return tx.Where("clock_fault IS NULL OR clock_fault = ?", NoClockFault)
+}
+
+// barrierTimeTolerance returns the time tolerance of the barrier
+func barrierTimeTolerance(barrierId uint) (time.Duration, error) {
+	var barrier RegisteredBarrier
+	if err := db.Limit(1).Find(&barrier, barrierId).Error; err != nil {
+		return 0, err
+	}
+	if barrier.TimeTolerance != nil {
+		return time.Duration(*barrier.TimeTolerance), nil
+	}
+	return timeTolerance, nil
+}
+
+// checkTimestamp validates the timestamp ts of a detection received at
+// time now. Replayed detections can be up to maxReplayAge old.
+func (b *Barrier) checkTimestamp(ts, now time.Time, replayed bool) (ClockFault, error) {
+	tolerance, err := barrierTimeTolerance(b.Id)
+	if err != nil {
+		return NoClockFault, err
+	}
+	maxAge := tolerance
+	if replayed {
+		maxAge = maxReplayAge
+	}
+	switch {
+	case ts.After(now.Add(tolerance)):
+		return FutureTimestamp, nil
+	case ts.Before(now.Add(-maxAge)):
+		return OldTimestamp, nil
+	}
+	return NoClockFault, nil
+}
+
+// reportClockFault notifies operators when the clock fault state of the
+// barrier changes.
+func (b *Barrier) reportClockFault(reason ClockFault, ts, now time.Time) {
+	fault := reason != NoClockFault
+	if !fault && !b.clockFault {
+		return
+	}
+	b.clockFault = fault
+	status := BarrierClockFault{
+		BarrierId: b.Id,
+		Fault:     fault,
+		Reason:    reason,
+		Time:      Time(now),
+		Timestamp: Time(ts),
+	}
+	if fault {
+		log.Printf("barrier%d: implausible timestamp %v (%s)", b.Id, ts, reason)
+	} else {
+		log.Printf("barrier%d: timestamps are plausible again", b.Id)
+	}
+	b.hub.updateBarrierHealth <- BarrierHealthUpdate{BarrierId: b.Id, ClockFault: &status}
+	b.hub.sendJSON(&struct {
+		BarrierClockFault BarrierClockFault `json:"barrierClockFault"`
+	}{status})
+}
+
+func getQuarantinedCrossings(c echo.Context) error {
+	var filter struct {
+		BarrierId uint `query:"barrier_id"`
+	}
+	if err := c.Bind(&filter); err != nil {
+		return err
+	}
+	query := db.Where("clock_fault <> ?", NoClockFault)
+	if filter.BarrierId != 0 {
+		query = query.Where("barrier_id = ?", filter.BarrierId)
+	}
+	crossings := []Crossing{}
+	if err := query.Order("id").Find(&crossings).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, crossings)
+}
+
+// releaseCrossing clears the clock fault of the quarantined crossing,
+// so it becomes an orphaned crossing (see attachCrossings). The request
+// can correct its timestamp.
+func releaseCrossing(c echo.Context) error {
+	var req struct {
+		ID   uint  `param:"id"`
+		Time *Time `json:"time"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	var crossing Crossing
+	if err := db.Limit(1).Find(&crossing, req.ID).Error; err != nil {
+		return err
+	}
+	if crossing.ID == 0 || crossing.ClockFault == NoClockFault {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("quarantined crossing with id %d not found", req.ID))
+	}
+	before, after := crossing, crossing
+	after.ClockFault = NoClockFault
+	if req.Time != nil {
+		after.Time = *req.Time
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&crossing).Select("ClockFault", "Time").Updates(&after).Error; err != nil {
+			return err
+		}
+		return auditTx(tx, c, "crossing", crossing.ID, 0, crossingAudit(&before), crossingAudit(&after))
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, after)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// RaceRef identifies a current race in websocket messages
+type RaceRef struct {
+	Id      uint `json:"id"`
+	EventId uint `json:"eventId"`
+	TrackId uint `json:"trackId"`
+}
+
+// CurrentRaces holds running (or paused) races. At most one race can
+// be running on each track and tracks of the current races must not
+// share barriers, so that each barrier feeds exactly one race.
+type CurrentRaces struct {
+	// Races keyed by track ID (0 for races without track)
+	races map[uint]*Race
+	mutex sync.Mutex
+}
+
+// trackKey returns the key of the race in CurrentRaces.races
+func trackKey(race *Race) uint {
+	if race.TrackID == nil {
+		return 0
+	}
+	return *race.TrackID
+}
+
+// set marks the race as current. race.Track must be preloaded.
+func (cr *CurrentRaces) set(race *Race) {
+	if cr.races == nil {
+		cr.races = make(map[uint]*Race)
+	}
+	cr.races[trackKey(race)] = race
+}
+
+func (cr *CurrentRaces) remove(race *Race) {
+	if current, ok := cr.races[trackKey(race)]; ok && current.ID == race.ID {
+		delete(cr.races, trackKey(race))
+	}
+}
+
+// conflicting returns a current race (other than race) running on the
+// same track or on a track sharing a barrier with the race's track.
+func (cr *CurrentRaces) conflicting(race *Race) *Race {
+	for key, current := range cr.races {
+		if current.ID == race.ID {
+			continue
+		}
+		if key == trackKey(race) {
+			return current
+		}
+		for _, b := range race.track().Barriers {
+			if current.track().barrier(b.BarrierId) != nil {
+				return current
+			}
+		}
+	}
+	return nil
+}
+
+// forBarrier returns ID of the current race, whose track contains the
+// barrier, or 0 if there is no such race.
+func (cr *CurrentRaces) forBarrier(barrierId uint) uint {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	for _, race := range cr.races {
+		if race.track().barrier(barrierId) != nil {
+			return race.ID
+		}
+	}
+	return 0
+}
+
+// forTrack returns ID of the current race on the track, or 0 if there
+// is no such race.
+func (cr *CurrentRaces) forTrack(trackId uint) uint {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if race, ok := cr.races[trackId]; ok {
+		return race.ID
+	}
+	return 0
+}
+
+// ids returns IDs of all current races
+func (cr *CurrentRaces) ids() []uint {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	ids := make([]uint, 0, len(cr.races))
+	for _, race := range cr.races {
+		ids = append(ids, race.ID)
+	}
+	return ids
+}
+
+// snapshot returns references to the current races ordered by track.
+// The caller must hold the mutex.
+func (cr *CurrentRaces) snapshot() []RaceRef {
+	refs := make([]RaceRef, 0, len(cr.races))
+	for key, race := range cr.races {
+		refs = append(refs, RaceRef{Id: race.ID, EventId: race.EventID, TrackId: key})
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].TrackId < refs[j].TrackId })
+	return refs
+}
+
+// currentRacesMessage returns the current races message for clients
+// watching the given event (0 means all events). currentRace contains
+// the first of currentRaces for clients supporting only one race.
+func currentRacesMessage(refs []RaceRef, eventId uint) ([]byte, error) {
+	var msg struct {
+		CurrentRace  *RaceRef  `json:"currentRace"`
+		CurrentRaces []RaceRef `json:"currentRaces"`
+	}
+	msg.CurrentRaces = make([]RaceRef, 0, len(refs))
+	for _, ref := range refs {
+		if eventId == 0 || ref.EventId == eventId {
+			msg.CurrentRaces = append(msg.CurrentRaces, ref)
+		}
+	}
+	if len(msg.CurrentRaces) > 0 {
+		msg.CurrentRace = &msg.CurrentRaces[0]
+	}
+	return json.Marshal(&msg)
+}
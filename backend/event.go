@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Event is a competition. Races belong to an event and teams register
+// to events, so that one database can hold several competitions.
+type Event struct {
+	CommonModelFields
+	Name      string `gorm:"uniqueIndex" json:"name"`
+	Venue     string `json:"venue"`
+	StartDate *Time  `json:"startDate,omitempty"`
+	EndDate   *Time  `json:"endDate,omitempty"`
+	Teams     []Team `gorm:"many2many:event_teams" json:"teams,omitempty"`
+}
+
+type EventRegistration struct {
+	ID     uint `param:"id"`
+	TeamID uint `json:"teamId" param:"team_id"`
+}
+
+// eventScope returns a scope limiting the query to the event given by
+// the event_id query parameter. Without the parameter, the query is
+// not limited.
+func eventScope(c echo.Context) (func(*gorm.DB) *gorm.DB, error) {
+	var eventId uint
+	if err := echo.QueryParamsBinder(c).Uint("event_id", &eventId).BindError(); err != nil {
+		return nil, err
+	}
+	return func(tx *gorm.DB) *gorm.DB {
+		if c.QueryParam("event_id") == "" {
+			return tx
+		}
+		return tx.Where("event_id = ?", eventId)
+	}, nil
+}
+
+// isTeamRegistered checks whether the team is registered to the event.
+// All teams are considered registered to races without an event.
+func isTeamRegistered(eventId uint, teamId uint) (bool, error) {
+	if eventId == 0 {
+		return true, nil
+	}
+	var cnt int64
+	err := db.Table("event_teams").Where("event_id = ? AND team_id = ?", eventId, teamId).Count(&cnt).Error
+	return cnt > 0, err
+}
+
+func findEvent(id uint, event *Event) error {
+	if err := db.Preload("Teams").First(event, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(
+				http.StatusNotFound,
+				fmt.Sprintf("event with id %d not found", id),
+			)
+		}
+		return err
+	}
+	return nil
+}
+
+func getAllEvents(c echo.Context) error {
+	var events []Event
+	if err := db.Find(&events).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, events)
+}
+
+func getEvent(c echo.Context) error {
+	var event Event
+	if err := c.Bind(&event); err != nil {
+		return err
+	}
+	if err := findEvent(event.ID, &event); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, event)
+}
+
+func createEvent(c echo.Context) error {
+	var event Event
+	if err := c.Bind(&event); err != nil {
+		return err
+	}
+	if event.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name not specified")
+	}
+	// teams are registered via /events/:id/teams
+	if err := db.Omit("Teams").Create(&event).Error; err != nil {
+		return err
+	}
+	audit(c, "event", event.ID, 0, nil, event)
+	return c.JSON(http.StatusOK, event)
+}
+
+func updateEvent(c echo.Context) error {
+	var event Event
+	if err := c.Bind(&event); err != nil {
+		return err
+	}
+	var old Event
+	if err := findEvent(event.ID, &old); err != nil {
+		return err
+	}
+	if err := db.Omit("Teams").Updates(&event).Error; err != nil {
+		return err
+	}
+	// the request may not contain all fields
+	if err := findEvent(event.ID, &event); err != nil {
+		return err
+	}
+	audit(c, "event", event.ID, 0, old, event)
+	return c.JSON(http.StatusOK, event)
+}
+
+func registerTeam(c echo.Context, register bool) error {
+	var reg EventRegistration
+	if err := c.Bind(&reg); err != nil {
+		return err
+	}
+	var event Event
+	if err := findEvent(reg.ID, &event); err != nil {
+		return err
+	}
+	var team Team
+	if err := db.First(&team, reg.TeamID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("no team with id %d", reg.TeamID),
+			)
+		}
+		return err
+	}
+	assoc := db.Model(&event).Association("Teams")
+	var err error
+	if register {
+		err = assoc.Append(&team)
+	} else {
+		err = assoc.Delete(&team)
+	}
+	if err != nil {
+		return err
+	}
+	before := event
+	if err := findEvent(reg.ID, &event); err != nil {
+		return err
+	}
+	audit(c, "event", event.ID, 0, before, event)
+	return c.JSON(http.StatusOK, event)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// IgnoreReason explains why the crossing is ignored
+type IgnoreReason string
+
+const (
+	NotIgnored IgnoreReason = ""
+	// Crossing came within the debounce window after the previous
+	// crossing of the same barrier
+	IgnoredByDebounce IgnoreReason = "debounce"
+	// The lap would be shorter than the minimum plausible lap time
+	IgnoredByMinLapTime IgnoreReason = "min_lap_time"
+	// Ignored manually by an operator
+	IgnoredByOperator IgnoreReason = "operator"
+)
+
+// When neither the race nor its track configures the debounce window,
+// the originally hard-coded rule applies: in head-to-head races, the
+// second crossing of a barrier is ignored if it comes within this time
+// after the first one. Other crossings are not debounced.
+const legacyDebounceTime = 1000 * time.Millisecond
+
+// SQL interface
+
+func (e *IgnoreReason) Scan(value interface{}) error {
+	// NULL for crossings stored before the column was added
+	s, _ := value.(string)
+	*e = IgnoreReason(s)
+	return nil
+}
+
+func (e IgnoreReason) Value() (driver.Value, error) {
+	return string(e), nil
+}
+
+// validateFilter checks the noise filter settings of a race or track
+func validateFilter(debounceTime, minLapTime *Duration) error {
+	if debounceTime != nil && *debounceTime < 0 {
+		return fmt.Errorf("debounceTime must not be negative")
+	}
+	if minLapTime != nil && *minLapTime < 0 {
+		return fmt.Errorf("minLapTime must not be negative")
+	}
+	return nil
+}
+
+// debounceTime returns the debounce window of the race's barriers and
+// whether it is configured. The race configuration takes precedence
+// over the track.
+func (r *Race) debounceTime() (time.Duration, bool) {
+	switch {
+	case r.DebounceTime != nil:
+		return time.Duration(*r.DebounceTime), true
+	case r.track().DebounceTime != nil:
+		return time.Duration(*r.track().DebounceTime), true
+	}
+	return 0, false
+}
+
+// minLapTime returns the minimum plausible lap time of the race (0 if
+// not limited). The race configuration takes precedence over the
+// track.
+func (r *Race) minLapTime() time.Duration {
+	switch {
+	case r.MinLapTime != nil:
+		return time.Duration(*r.MinLapTime)
+	case r.track().MinLapTime != nil:
+		return time.Duration(*r.track().MinLapTime)
+	}
+	return 0
+}
+
+// autoIgnoreReason checks whether the new crossing of the race is
+// noise: it comes within the debounce window after the previous counted
+// crossing of the same barrier or, if it is a lap crossing, less than
+// the minimum lap time after the previous lap crossing of the team.
+// crossing.Team must already be assigned. race.Track (with Barriers)
+// and race.Pauses must be preloaded.
+func autoIgnoreReason(tx *gorm.DB, race *Race, crossing *Crossing) (IgnoreReason, error) {
+	ts := time.Time(crossing.Time)
+	debounced, err := isDebounced(tx, race, crossing)
+	if err != nil || debounced {
+		return IgnoredByDebounce, err
+	}
+	minLap := race.minLapTime()
+	if minLap <= 0 || race.track().lapBarrier(crossing.Team) != crossing.BarrierId {
+		return NotIgnored, nil
+	}
+	var last Crossing
+	err = tx.Where("race_id = ? AND barrier_id = ? AND team = ? AND ignored = ? AND paused = ? AND time <= ?",
+		race.ID, crossing.BarrierId, crossing.Team, false, false, ts).
+		Order("time DESC").Limit(1).Find(&last).Error
+	if err != nil {
+		return NotIgnored, err
+	}
+	if last.ID == 0 {
+		return NotIgnored, nil
+	}
+	lapTime := ts.Sub(time.Time(last.Time)) - pausedDuration(race.Pauses, time.Time(last.Time), ts)
+	if lapTime < minLap {
+		return IgnoredByMinLapTime, nil
+	}
+	return NotIgnored, nil
+}
+
+// isDebounced checks whether the crossing comes within the debounce
+// window after a counted (not ignored) crossing of the same barrier.
+func isDebounced(tx *gorm.DB, race *Race, crossing *Crossing) (bool, error) {
+	ts := time.Time(crossing.Time)
+	debounce, configured := race.debounceTime()
+	if configured {
+		if debounce <= 0 {
+			return false, nil
+		}
+		var cnt int64
+		err := tx.Model(&Crossing{}).
+			Where("race_id = ? AND barrier_id = ? AND ignored = ? AND paused = ? AND time > ? AND time <= ? AND id <> ?",
+				race.ID, crossing.BarrierId, false, false, ts.Add(-debounce), ts, crossing.ID).
+			Count(&cnt).Error
+		return cnt > 0, err
+	}
+	if race.Type != HeadToHead {
+		return false, nil
+	}
+	var previous []Crossing
+	err := tx.Where("race_id = ? AND barrier_id = ? AND ignored = ? AND time <= ? AND id <> ?",
+		race.ID, crossing.BarrierId, false, ts, crossing.ID).
+		Limit(2).Find(&previous).Error
+	if err != nil || len(previous) != 1 {
+		return false, err
+	}
+	return ts.Sub(time.Time(previous[0].Time)) < legacyDebounceTime, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Barriers can be grouped on a track, e.g. two sensors at the
+// start/finish line, so that a single missed detection does not cost a
+// team a lap. Members of a group refer to the group's main barrier
+// (TrackBarrier.Group). Detections of group members within the track's
+// fusion window are merged into one logical crossing with BarrierId of
+// the main barrier. The raw detections are stored as Detection.
+
+// Default fusion window of barrier groups
+const defaultFusionWindow = 100 * time.Millisecond
+
+// Storing of detections is serialized per group, because each sensor
+// has its own reader and detections of the same car arrive at nearly
+// the same time.
+var (
+	groupLocksMutex sync.Mutex
+	groupLocks      = make(map[uint]*sync.Mutex)
+)
+
+// lockGroups locks the groups (identified by their main barriers) and
+// returns the function unlocking them.
+func lockGroups(groups ...uint) (unlock func()) {
+	sorted := append([]uint(nil), groups...)
+	// always lock in the same order to avoid deadlocks
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var locks []*sync.Mutex
+	groupLocksMutex.Lock()
+	for _, group := range sorted {
+		lock, ok := groupLocks[group]
+		if !ok {
+			lock = &sync.Mutex{}
+			groupLocks[group] = lock
+		}
+		locks = append(locks, lock)
+	}
+	groupLocksMutex.Unlock()
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// Detection is a raw detection of a grouped barrier (sensor)
+type Detection struct {
+	ID uint `gorm:"primaryKey" json:"id"`
+	// Barrier (sensor) which detected the car
+	BarrierId uint `json:"barrierId" gorm:"uniqueIndex:idx_detection_barrier_boot_seq"`
+	// Boot identifier and sequence number of the detection sent by
+	// the barrier (if any)
+	Boot uint64  `json:"boot,omitempty" gorm:"default:0;uniqueIndex:idx_detection_barrier_boot_seq"`
+	Seq  *uint64 `json:"seq,omitempty" gorm:"uniqueIndex:idx_detection_barrier_boot_seq"`
+	// Corrected and original barrier time
+	Time    Time  `json:"time"`
+	RawTime *Time `json:"rawTime,omitempty"`
+	// The logical crossing the detection was merged into
+	CrossingID uint `gorm:"index" json:"crossingId"`
+}
+
+// SensorStats describes how reliably a group member detects cars
+type SensorStats struct {
+	// Main barrier of the group
+	Group     uint `json:"group"`
+	BarrierId uint `json:"barrierId"`
+	// Logical crossings of the group detected by any sensor
+	Crossings int `json:"crossings"`
+	// Crossings detected by this sensor
+	Detected int `json:"detected"`
+	// Crossings missed by this sensor
+	Missed int `json:"missed"`
+}
+
+// group returns the main barrier of the group the barrier belongs to.
+// If the barrier is not grouped, it returns 0.
+func (t *Track) group(barrierId uint) uint {
+	b := t.barrier(barrierId)
+	if b == nil {
+		return 0
+	}
+	if b.Group != 0 {
+		return b.Group
+	}
+	for i := range t.Barriers {
+		if t.Barriers[i].Group == barrierId {
+			return barrierId
+		}
+	}
+	return 0
+}
+
+// groups returns main barriers of all groups of the track
+func (t *Track) groups() []uint {
+	var groups []uint
+	for i := range t.Barriers {
+		if b := &t.Barriers[i]; b.Group == 0 && t.group(b.BarrierId) != 0 {
+			groups = append(groups, b.BarrierId)
+		}
+	}
+	return groups
+}
+
+func (t *Track) fusionWindow() time.Duration {
+	if t.FusionWindow != nil {
+		return time.Duration(*t.FusionWindow)
+	}
+	return defaultFusionWindow
+}
+
+// validateGroup checks that the barrier can be a member of its group
+func (t *Track) validateGroup(b *TrackBarrier) error {
+	if b.Group == 0 {
+		return nil
+	}
+	primary := t.barrier(b.Group)
+	switch {
+	case b.Group == b.BarrierId || primary == nil:
+		return fmt.Errorf("group %d of barrier %d is not another barrier of the track", b.Group, b.BarrierId)
+	case primary.Group != 0:
+		return fmt.Errorf("barrier %d is a group member, so it cannot be the group of barrier %d", b.Group, b.BarrierId)
+	case primary.Role != b.Role || primary.Checkpoint != b.Checkpoint:
+		return fmt.Errorf("barrier %d must have the same role as its group barrier %d", b.BarrierId, b.Group)
+	case b.BarrierId == t.TeamALapBarrier || b.BarrierId == t.TeamBLapBarrier:
+		return fmt.Errorf("lap barrier %d is a group member, use its group barrier %d", b.BarrierId, b.Group)
+	}
+	return nil
+}
+
+// fusedDuplicate returns the crossing containing an already stored
+// detection of the grouped barrier (see Barrier.storeCrossing).
+func fusedDuplicate(barrierId uint, boot uint64, seq *uint64, rawTs Time, replayed bool) (crossing Crossing, err error) {
+	var detection Detection
+	if seq != nil {
+		err = db.Where("barrier_id = ? AND boot = ? AND seq = ?", barrierId, boot, *seq).Limit(1).Find(&detection).Error
+	} else if replayed {
+		err = db.Where("barrier_id = ? AND raw_time = ?", barrierId, rawTs).Limit(1).Find(&detection).Error
+	}
+	if err != nil || detection.ID == 0 {
+		return
+	}
+	err = db.Limit(1).Find(&crossing, detection.CrossingID).Error
+	return
+}
+
+// fusedCrossing returns the logical crossing of the group within the
+// fusion window around ts, which was not detected by the sensor yet.
+// crossing.ID is 0 if there is no such crossing.
+func fusedCrossing(tx *gorm.DB, race *Race, group, sensor uint, ts Time) (crossing Crossing, err error) {
+	window := race.track().fusionWindow()
+	t := time.Time(ts)
+	err = tx.Where("race_id = ? AND barrier_id = ? AND time BETWEEN ? AND ?", race.ID, group, t.Add(-window), t.Add(window)).
+		// only crossings made of detections (not manual ones)
+		Where("EXISTS (SELECT 1 FROM detections WHERE detections.crossing_id = crossings.id)").
+		Where("NOT EXISTS (SELECT 1 FROM detections WHERE detections.crossing_id = crossings.id AND detections.barrier_id = ?)", sensor).
+		Order("time").Limit(1).Find(&crossing).Error
+	return
+}
+
+// fuseAttachedCrossing merges the orphaned crossing of a grouped barrier
+// being attached to the race in the same way as Barrier.storeCrossing
+// merges detections. The crossing is stored as a detection and either
+// merged into an existing crossing of the group (then it is deleted and
+// merged is true) or it becomes the group's crossing. The caller must
+// lock the group.
+func fuseAttachedCrossing(tx *gorm.DB, race *Race, crossing *Crossing) (merged bool, err error) {
+	group := race.track().group(crossing.BarrierId)
+	if group == 0 {
+		return false, nil
+	}
+	detection := Detection{BarrierId: crossing.BarrierId, Boot: crossing.Boot, Seq: crossing.Seq, Time: crossing.Time, RawTime: crossing.RawTime}
+	fused, err := fusedCrossing(tx, race, group, crossing.BarrierId, crossing.Time)
+	if err != nil {
+		return false, err
+	}
+	if fused.ID != 0 {
+		detection.CrossingID = fused.ID
+		if err := tx.Delete(crossing).Error; err != nil {
+			return false, err
+		}
+		return true, tx.Create(&detection).Error
+	}
+	// the sequence number belongs to the detection now
+	if err := tx.Model(crossing).Select("BarrierId", "Boot", "Seq").Updates(&Crossing{BarrierId: group}).Error; err != nil {
+		return false, err
+	}
+	crossing.BarrierId, crossing.Boot, crossing.Seq = group, 0, nil
+	detection.CrossingID = crossing.ID
+	return false, tx.Create(&detection).Error
+}
+
+// getRaceSensors returns raw detections of grouped barriers in the race
+// and per-sensor miss statistics.
+func getRaceSensors(c echo.Context) error {
+	var raceId uint
+	if err := echo.PathParamsBinder(c).MustUint("id", &raceId).BindError(); err != nil {
+		return err
+	}
+	var race Race
+	if err := findRace(raceId, &race, raceDetails); err != nil {
+		return err
+	}
+	detections := []Detection{}
+	err := db.Joins("JOIN crossings ON crossings.id = detections.crossing_id").
+		Where("crossings.race_id = ?", race.ID).Order("detections.time").Find(&detections).Error
+	if err != nil {
+		return err
+	}
+	// sensors which detected each logical crossing
+	detected := make(map[uint]map[uint]bool)
+	for _, d := range detections {
+		if detected[d.CrossingID] == nil {
+			detected[d.CrossingID] = make(map[uint]bool)
+		}
+		detected[d.CrossingID][d.BarrierId] = true
+	}
+	track := race.track()
+	stats := []SensorStats{}
+	for _, b := range track.Barriers {
+		group := track.group(b.BarrierId)
+		if group == 0 {
+			continue
+		}
+		s := SensorStats{Group: group, BarrierId: b.BarrierId}
+		for _, crossing := range race.Crossings {
+			if crossing.BarrierId != group || detected[crossing.ID] == nil {
+				continue
+			}
+			s.Crossings++
+			if detected[crossing.ID][b.BarrierId] {
+				s.Detected++
+			}
+		}
+		s.Missed = s.Crossings - s.Detected
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Group != stats[j].Group {
+			return stats[i].Group < stats[j].Group
+		}
+		return stats[i].BarrierId < stats[j].BarrierId
+	})
+	return c.JSON(http.StatusOK, &struct {
+		Stats      []SensorStats `json:"stats"`
+		Detections []Detection   `json:"detections"`
+	}{stats, detections})
+}
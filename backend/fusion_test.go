@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startGroupedRace starts a time trial on a track where barrier 3 is a
+// redundant sensor of the lap barrier 1 and barrier 2 is a checkpoint
+func startGroupedRace(t *testing.T) Race {
+	t.Helper()
+	track := Track{
+		Name:            "grouped",
+		TeamALapBarrier: 1,
+		Barriers: []TrackBarrier{
+			{BarrierId: 1, Role: LapLine},
+			{BarrierId: 2, Role: Checkpoint, Checkpoint: 1},
+			{BarrierId: 3, Role: LapLine, Group: 1},
+		},
+	}
+	if err := db.Create(&track).Error; err != nil {
+		t.Fatal(err)
+	}
+	race := Race{Type: TimeTrial, TrackID: &track.ID, Track: &track}
+	startTestRace(t, &race)
+	return race
+}
+
+func countDetections(t *testing.T, crossingId uint) int64 {
+	t.Helper()
+	var n int64
+	if err := db.Model(&Detection{}).Where("crossing_id = ?", crossingId).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestStoreCrossingFusion(t *testing.T) {
+	setupTestDb(t)
+	race := startGroupedRace(t)
+	now := time.Now()
+	lap, sensor, checkpoint := &Barrier{Id: 1, hub: hub}, &Barrier{Id: 3, hub: hub}, &Barrier{Id: 2, hub: hub}
+
+	first, _, err := lap.storeCrossing(testMessage(now, 0, 7, seqPtr(1)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.BarrierId != 1 || first.RaceID != race.ID || first.Seq != nil {
+		t.Errorf("crossing of barrier %d in race %d with seq %v, want barrier 1 in race %d without seq",
+			first.BarrierId, first.RaceID, first.Seq, race.ID)
+	}
+	// the other sensor detects the same car within the fusion window
+	merged, duplicate, err := sensor.storeCrossing(testMessage(now, 30*time.Millisecond, 8, seqPtr(1)), false)
+	if err != nil || duplicate || merged.ID != first.ID {
+		t.Errorf("detection of the sensor: crossing %d, duplicate = %v, err = %v, want crossing %d",
+			merged.ID, duplicate, err, first.ID)
+	}
+	// the sensor resends the detection
+	resent, duplicate, err := sensor.storeCrossing(testMessage(now, 30*time.Millisecond, 8, seqPtr(1)), false)
+	if err != nil || !duplicate || resent.ID != first.ID {
+		t.Errorf("resent detection: crossing %d, duplicate = %v, err = %v, want crossing %d, duplicate",
+			resent.ID, duplicate, err, first.ID)
+	}
+	if n := countDetections(t, first.ID); n != 2 {
+		t.Errorf("%d detections of the crossing, want 2", n)
+	}
+	// ungrouped barriers and detections outside the window are not merged
+	if c, _, err := checkpoint.storeCrossing(testMessage(now, 50*time.Millisecond, 9, seqPtr(1)), false); err != nil || c.ID == first.ID {
+		t.Errorf("checkpoint detection merged into crossing %d, err = %v", c.ID, err)
+	}
+	later, _, err := sensor.storeCrossing(testMessage(now, 2*time.Second, 8, seqPtr(2)), false)
+	if err != nil || later.ID == first.ID || later.BarrierId != 1 {
+		t.Errorf("later detection: crossing %d of barrier %d, err = %v, want new crossing of barrier 1",
+			later.ID, later.BarrierId, err)
+	}
+	if n := countCrossings(t); n != 3 {
+		t.Errorf("%d crossings stored, want 3", n)
+	}
+}
+
+func TestAttachCrossingsFusion(t *testing.T) {
+	setupTestDb(t)
+	// detections of both sensors stored before the race was started
+	ids := storeOrphans(t, 1, 10*time.Second)
+	ids = append(ids, storeOrphans(t, 3, 10*time.Second+30*time.Millisecond)...)
+	race := startGroupedRace(t)
+
+	body := fmt.Sprintf(`{"crossingIds": [%d, %d]}`, ids[0], ids[1])
+	rec, err := callHandler(attachCrossings, jsonRequest(http.MethodPost, body), race.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attached []Crossing
+	if err := json.Unmarshal(rec.Body.Bytes(), &attached); err != nil {
+		t.Fatal(err)
+	}
+	if len(attached) != 1 || attached[0].ID != ids[0] || attached[0].BarrierId != 1 {
+		t.Fatalf("attached %+v, want crossing %d of barrier 1", attached, ids[0])
+	}
+	if n := countCrossings(t); n != 1 {
+		t.Errorf("%d crossings stored, want 1", n)
+	}
+	if n := countDetections(t, ids[0]); n != 2 {
+		t.Errorf("%d detections of the crossing, want 2", n)
+	}
+}
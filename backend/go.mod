@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/gorilla/websocket v1.4.2
 	github.com/labstack/echo/v4 v4.6.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	gorm.io/driver/sqlite v1.1.5
 	gorm.io/gorm v1.21.15
 )
@@ -19,7 +20,6 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.8 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.1 // indirect
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
 	golang.org/x/net v0.0.0-20210924151903-3ad01bbaa167 // indirect
 	golang.org/x/sys v0.0.0-20210925032602-92d5a993a665 // indirect
 	golang.org/x/text v0.3.7 // indirect
@@ -6,15 +6,49 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"sort"
+	"time"
 )
 
+// ScopedMessage is a message related to an event. It is sent only to
+// clients watching the event and to clients watching all events.
+// Messages with zero EventId are sent to all clients.
+type ScopedMessage struct {
+	EventId uint
+	Message []byte
+}
+
+// barrierRegistration is the hub's reply to a barrier registration
+type barrierRegistration struct {
+	// The replaced connection of the barrier (if any)
+	previous *Barrier
+	// Set if the registration was rejected
+	err error
+}
+
+// takeoverCheck tells whether the existing connection of a barrier
+// answered a ping when a new connection of the barrier was made
+type takeoverCheck struct {
+	barrier  *Barrier
+	previous *Barrier
+	alive    bool
+}
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
 	// Inbound messages from the clients.
 	broadcast chan []byte
 
+	// Inbound messages related to an event.
+	broadcastScoped chan ScopedMessage
+
+	// Changes of current races, sent to each client according to
+	// the event it watches.
+	broadcastCurrentRaces chan []RaceRef
+
 	// Registered clients.
 	clients map[*Client]bool
 
@@ -32,11 +66,29 @@ type Hub struct {
 
 	// Unregister requests from barriers.
 	unregisterBarrier chan *Barrier
+
+	// Results of pinging existing connections of barriers that
+	// connected again.
+	takeoverChecked chan takeoverCheck
+
+	// Requests to close the connection of a barrier.
+	disconnectBarrier chan uint
+
+	// Latest health of barriers (including disconnected ones).
+	barrierHealth map[uint]*BarrierHealth
+
+	// Health updates from the barriers.
+	updateBarrierHealth chan BarrierHealthUpdate
+
+	// Requests for the health of all barriers.
+	barrierHealthRequest chan chan []BarrierHealth
 }
 
 func newHub() *Hub {
 	return &Hub{
-		broadcast: make(chan []byte),
+		broadcast:             make(chan []byte),
+		broadcastScoped:       make(chan ScopedMessage),
+		broadcastCurrentRaces: make(chan []RaceRef),
 
 		clients:          make(map[*Client]bool),
 		registerClient:   make(chan *Client),
@@ -45,6 +97,12 @@ func newHub() *Hub {
 		barriers:          make(map[uint]*Barrier),
 		registerBarrier:   make(chan *Barrier),
 		unregisterBarrier: make(chan *Barrier),
+		takeoverChecked:   make(chan takeoverCheck),
+		disconnectBarrier: make(chan uint),
+
+		barrierHealth:        make(map[uint]*BarrierHealth),
+		updateBarrierHealth:  make(chan BarrierHealthUpdate),
+		barrierHealthRequest: make(chan chan []BarrierHealth),
 	}
 }
 
@@ -59,14 +117,62 @@ func (h *Hub) sendBroadcast(message []byte) {
 	}
 }
 
+// sendJSON broadcasts JSON-encoded v to all clients
+func (h *Hub) sendJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("broadcast marshal error: %v", err)
+		return
+	}
+	h.broadcast <- b
+}
+
+func (h *Hub) sendScoped(msg ScopedMessage) {
+	for client := range h.clients {
+		if msg.EventId != 0 && client.eventId != 0 && client.eventId != msg.EventId {
+			continue
+		}
+		select {
+		case client.send <- msg.Message:
+		default:
+			close(client.send)
+			delete(h.clients, client)
+		}
+	}
+}
+
+func (h *Hub) sendCurrentRaces(refs []RaceRef) {
+	messages := make(map[uint][]byte)
+	for client := range h.clients {
+		message, ok := messages[client.eventId]
+		if !ok {
+			var err error
+			if message, err = currentRacesMessage(refs, client.eventId); err != nil {
+				log.Printf("current races marshal error: %v", err)
+				return
+			}
+			messages[client.eventId] = message
+		}
+		select {
+		case client.send <- message:
+		default:
+			close(client.send)
+			delete(h.clients, client)
+		}
+	}
+}
+
 func (h *Hub) getBarrierStatusMsg() ([]byte, error) {
 	type BarrierStatus struct {
-		Barriers []uint `json:"barriers"`
+		// IDs of connected barriers
+		Barriers      []uint          `json:"barriers"`
+		BarrierHealth []BarrierHealth `json:"barrierHealth"`
 	}
-	bs := BarrierStatus{Barriers: make([]uint, 0)}
+	bs := BarrierStatus{Barriers: make([]uint, 0), BarrierHealth: h.healthSnapshot()}
 	for _, barrier := range h.barriers {
 		bs.Barriers = append(bs.Barriers, barrier.Id)
 	}
+	sort.Slice(bs.Barriers, func(i, j int) bool { return bs.Barriers[i] < bs.Barriers[j] })
 	b, err := json.Marshal(bs)
 	if err != nil {
 		log.Printf("barrier status marshal error: %v", err)
@@ -74,6 +180,21 @@ func (h *Hub) getBarrierStatusMsg() ([]byte, error) {
 	return b, err
 }
 
+// addBarrier registers the connection of the barrier, which replaces
+// the previous one (if any). It must be called from the hub goroutine.
+func (h *Hub) addBarrier(barrier, previous *Barrier) {
+	now := Time(time.Now())
+	barrier.registered <- barrierRegistration{previous: previous}
+	h.barriers[barrier.Id] = barrier
+	health := h.health(barrier.Id)
+	health.Connected = true
+	health.ConnectedAt = &now
+	health.Rtt = nil
+	if b, err := h.getBarrierStatusMsg(); err == nil {
+		h.sendBroadcast(b)
+	}
+}
+
 func (h *Hub) run() {
 	for {
 		select {
@@ -91,25 +212,79 @@ func (h *Hub) run() {
 				close(client.send)
 			}
 		case barrier := <-h.registerBarrier:
-			if _, ok := h.barriers[barrier.Id]; ok {
-				barrier.RegistrationOk <- false
+			previous, ok := h.barriers[barrier.Id]
+			if !ok {
+				log.Printf("registering barrier %d\n", barrier.Id)
+				h.addBarrier(barrier, nil)
+				break
+			}
+			// The previous connection is either stale (e.g. Wi-Fi
+			// dropped without closing it) or another device uses the
+			// same barrier ID. Only a stale one does not answer
+			// pings. The hub must not wait for the answer.
+			go func() {
+				h.takeoverChecked <- takeoverCheck{barrier, previous, previous.answersPing()}
+			}()
+		case check := <-h.takeoverChecked:
+			barrier := check.barrier
+			if h.barriers[barrier.Id] != check.previous {
+				// the connection changed in the meantime
+				go func() { h.registerBarrier <- barrier }()
 				break
+			}
+			health := h.health(barrier.Id)
+			takeover := BarrierTakeover{BarrierId: barrier.Id, Time: Time(time.Now()), PreviousConnectedAt: health.ConnectedAt, Rejected: check.alive}
+			if check.alive {
+				log.Printf("WARNING: barrier %d connected again while its previous connection answers pings, rejecting (does another device use the same ID?)\n", barrier.Id)
+				health.RejectedTakeovers++
 			} else {
-				h.barriers[barrier.Id] = barrier
-				barrier.RegistrationOk <- true
-				log.Printf("registering barrier %d\n", barrier.Id)
+				log.Printf("barrier %d reconnected, closing the previous connection\n", barrier.Id)
+				check.previous.disconnect()
+				health.Takeovers++
 			}
-			if b, err := h.getBarrierStatusMsg(); err == nil {
+			if b, err := json.Marshal(&struct {
+				BarrierTakeover BarrierTakeover `json:"barrierTakeover"`
+			}{takeover}); err == nil {
 				h.sendBroadcast(b)
 			}
+			if check.alive {
+				barrier.registered <- barrierRegistration{err: fmt.Errorf("barrier %d is already connected", barrier.Id)}
+				if b, err := h.getBarrierStatusMsg(); err == nil {
+					h.sendBroadcast(b)
+				}
+				break
+			}
+			h.addBarrier(barrier, check.previous)
 		case barrier := <-h.unregisterBarrier:
+			if h.barriers[barrier.Id] != barrier {
+				// replaced by a newer connection
+				log.Printf("previous connection of barrier %d closed\n", barrier.Id)
+				break
+			}
 			log.Printf("unregistering barrier %d\n", barrier.Id)
 			delete(h.barriers, barrier.Id)
+			h.health(barrier.Id).Connected = false
 			if b, err := h.getBarrierStatusMsg(); err == nil {
 				h.sendBroadcast(b)
 			}
+		case id := <-h.disconnectBarrier:
+			if barrier, ok := h.barriers[id]; ok {
+				log.Printf("disconnecting barrier %d\n", id)
+				barrier.disconnect()
+			}
 		case message := <-h.broadcast:
 			h.sendBroadcast(message)
+		case message := <-h.broadcastScoped:
+			h.sendScoped(message)
+		case refs := <-h.broadcastCurrentRaces:
+			h.sendCurrentRaces(refs)
+		case update := <-h.updateBarrierHealth:
+			h.updateHealth(update)
+			if b, err := h.getBarrierStatusMsg(); err == nil {
+				h.sendBroadcast(b)
+			}
+		case reply := <-h.barrierHealthRequest:
+			reply <- h.healthSnapshot()
 		}
 	}
 }
@@ -9,7 +9,7 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -34,25 +34,70 @@ type Team struct {
 
 type Race struct {
 	CommonModelFields
-	Type         RaceType   `json:"type" gorm:"index"`
-	State        RaceState  `json:"state" gorm:"index"`
-	Round        uint32     `json:"round"`
-	TeamAID      uint       `json:"teamAId" query:"team_a_id"`
-	TeamA        Team       `json:"teamA"`
-	TimeDuration *Duration  `json:"timeDuration,omitempty"`              // if Type != TimeTrial then TimeDuration == nil
-	LapsDuration *uint      `json:"lapsDuration,omitempty"`              // if Type != HeadToHead then LapsDuration == nil
-	TeamBID      *int       `json:"teamBId,omitempty" query:"team_b_id"` // if Type != HeadToHead then TeamBId == nil
-	TeamB        *Team      `json:"teamB,omitempty"`                     // if Type != HeadToHead then TeamB == nil
-	Crossings    []Crossing `json:"crossings"`
+	Type         RaceType     `json:"type" gorm:"index"`
+	State        RaceState    `json:"state" gorm:"index"`
+	Round        uint32       `json:"round"`
+	EventID      uint         `json:"eventId" gorm:"index" query:"event_id"` // 0 for races not belonging to any event
+	TeamAID      uint         `json:"teamAId" query:"team_a_id"`
+	TeamA        Team         `json:"teamA"`
+	TimeDuration *Duration    `json:"timeDuration,omitempty"`              // if Type != TimeTrial then TimeDuration == nil
+	LapsDuration *uint        `json:"lapsDuration,omitempty"`              // if Type != HeadToHead then LapsDuration == nil
+	TeamBID      *int         `json:"teamBId,omitempty" query:"team_b_id"` // if Type != HeadToHead then TeamBId == nil
+	TeamB        *Team        `json:"teamB,omitempty"`                     // if Type != HeadToHead then TeamB == nil
+	StartedAt    *Time        `json:"startedAt,omitempty"`                 // official start time
+	StoppedAt    *Time        `json:"stoppedAt,omitempty"`
+	FinishReason FinishReason `json:"finishReason,omitempty"` // what ended the race
+	// Set when the team has a crossing before the official start
+	// (TeamA is also used for time trials)
+	TeamAFalseStart bool   `json:"teamAFalseStart"`
+	TeamBFalseStart bool   `json:"teamBFalseStart"`
+	TrackID         *uint  `json:"trackId,omitempty"` // if nil, defaultTrack is used
+	Track           *Track `json:"track,omitempty"`
+	// Override the noise filter settings of the track (see filter.go)
+	DebounceTime *Duration `json:"debounceTime,omitempty"`
+	MinLapTime   *Duration `json:"minLapTime,omitempty"`
+	// How crossings of head-to-head races are assigned to teams
+	// (round robin if empty)
+	AssignmentStrategy AssignmentStrategy `json:"assignmentStrategy,omitempty"`
+	Pauses             []RacePause        `json:"pauses"`
+	Penalties          []Penalty          `json:"penalties"`
+	Crossings          []Crossing         `json:"crossings"`
 }
 
 type Crossing struct {
-	ID        uint         `gorm:"primaryKey" json:"id" param:"id" query:"id"`
-	UpdatedAt Time         `json:"updatedAt"`
-	Time      Time         `json:"time"`
-	Ignored   bool         `json:"ignored"`
-	BarrierId uint         `json:"barrierId"`
-	Team      CrossingTeam `json:"team"`
+	ID        uint `gorm:"primaryKey" json:"id" param:"id" query:"id"`
+	UpdatedAt Time `json:"updatedAt"`
+	Time      Time `json:"time"`
+	// Time reported by the barrier before clock offset correction
+	RawTime *Time `json:"rawTime,omitempty"`
+	Ignored bool  `json:"ignored"`
+	// Why the crossing is ignored. Crossings ignored automatically
+	// by the noise filter have "debounce" or "min_lap_time".
+	IgnoreReason IgnoreReason `json:"ignoreReason,omitempty"`
+	BarrierId    uint         `json:"barrierId" gorm:"uniqueIndex:idx_barrier_boot_seq"`
+	// Boot identifier and sequence number of the detection sent by
+	// the barrier (if any)
+	Boot uint64       `json:"boot,omitempty" gorm:"default:0;uniqueIndex:idx_barrier_boot_seq"`
+	Seq  *uint64      `json:"seq,omitempty" gorm:"uniqueIndex:idx_barrier_boot_seq"`
+	Team CrossingTeam `json:"team"`
+	// The crossing happened while the race was paused. Such crossings
+	// are not counted in race stats.
+	Paused bool `json:"paused"`
+	// The crossing happened before the official start of the race
+	FalseStart bool `json:"falseStart"`
+	// Identifier of the car reported by the barrier (if any)
+	CarId string `json:"carId,omitempty"`
+	// The team of the identified car differs from the team guessed
+	// by the assignment strategy (or the car is not in the race)
+	TeamMismatch bool `json:"teamMismatch,omitempty"`
+	// The crossing was added by an operator (e.g. when the barrier
+	// missed the car) rather than detected by the barrier
+	Manual bool `json:"manual"`
+	// Operator who created the manual crossing (see auditActor)
+	CreatedBy string `json:"createdBy,omitempty"`
+	// The barrier timestamp was implausible, so the crossing was
+	// quarantined (see clockfault.go)
+	ClockFault ClockFault `json:"clockFault,omitempty"`
 	// If 0, the crossing is not associated to any race
 	RaceID uint `json:"-"`
 }
@@ -63,16 +108,11 @@ type CrossingUpdate struct {
 	Team    CrossingTeam `json:"team"`
 }
 
-type CurrentRace struct {
-	race  *Race
-	mutex sync.Mutex
-}
-
 var (
-	db          *gorm.DB
-	hub         *Hub
-	keys        map[string]string
-	currentRace CurrentRace
+	db           *gorm.DB
+	hub          *Hub
+	keys         map[string]string
+	currentRaces CurrentRaces
 )
 
 func getRace(c echo.Context) error {
@@ -80,7 +120,7 @@ func getRace(c echo.Context) error {
 	if err := c.Bind(&race); err != nil {
 		return err
 	}
-	if err := db.Preload("TeamA").Preload("TeamB").Preload("Crossings").First(&race, race.ID).Error; err != nil {
+	if err := db.Scopes(raceDetails).Preload("TeamA").Preload("TeamB").First(&race, race.ID).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return echo.NewHTTPError(
 				http.StatusNotFound,
@@ -92,95 +132,172 @@ func getRace(c echo.Context) error {
 	return c.JSON(http.StatusOK, race)
 }
 
-func (cr *CurrentRace) MarshalJSON() ([]byte, error) {
-	type RaceID struct {
-		Id uint `json:"id"`
-	}
-	var msg struct {
-		CurrentRace *RaceID `json:"currentRace"`
-	}
-
-	if cr.race != nil {
-		msg.CurrentRace = &RaceID{Id: cr.race.ID}
+// findRace loads the race with optional scopes (e.g. preloads)
+func findRace(id uint, race *Race, scopes ...func(*gorm.DB) *gorm.DB) error {
+	if err := db.Scopes(scopes...).First(race, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(
+				http.StatusNotFound,
+				fmt.Sprintf("race with id %d not found", id),
+			)
+		}
+		return err
 	}
+	return nil
+}
 
-	return json.Marshal(&msg)
+// raceDetails is a scope loading everything needed to compute race stats
+func raceDetails(tx *gorm.DB) *gorm.DB {
+	return tx.Preload("Crossings").Preload("Pauses").Preload("Penalties").Preload("Track.Barriers")
 }
 
-func setRaceState(c echo.Context, state RaceState) error {
+// setRaceState changes the state of the race, which must be in one of
+// the from states.
+func setRaceState(c echo.Context, state RaceState, from ...RaceState) error {
 	var race Race
 	if err := c.Bind(&race); err != nil {
 		return err
 	}
+	c.Set(auditedKey, true)
+	entry := newAuditEntry(c, "race", race.ID, race.ID, nil, nil)
+	race, err := changeRaceState(race.ID, from, state, FinishedByOperator, entry)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, race)
+}
+
+// RaceStateAudit is the part of the race recorded in the audit log
+// when the race state changes
+type RaceStateAudit struct {
+	State        RaceState    `json:"state"`
+	StartedAt    *Time        `json:"startedAt,omitempty"`
+	StoppedAt    *Time        `json:"stoppedAt,omitempty"`
+	FinishReason FinishReason `json:"finishReason,omitempty"`
+}
+
+func raceStateAudit(race *Race) RaceStateAudit {
+	return RaceStateAudit{race.State, race.StartedAt, race.StoppedAt, race.FinishReason}
+}
+
+// changeRaceState changes state of the race from one of the from states
+// to state, updates currentRaces and broadcasts the change. reason is
+// recorded when the race is finished. The change is recorded in the
+// audit log using entry (with Actor and Action filled in).
+func changeRaceState(raceId uint, from []RaceState, state RaceState, reason FinishReason, entry *AuditEntry) (Race, error) {
+	var race Race
+	race.ID = raceId
 	err := db.Transaction(func(tx *gorm.DB) error {
-		currentRace.mutex.Lock()
-		defer currentRace.mutex.Unlock()
+		currentRaces.mutex.Lock()
+		defer currentRaces.mutex.Unlock()
 
-		if err := tx.First(&race, race.ID).Error; err != nil {
+		if err := tx.Preload("Track.Barriers").First(&race, race.ID).Error; err != nil {
 			return err
 		}
-		var expectedState RaceState
 		switch state {
-		case Running:
-			if currentRace.race != nil {
-				return echo.NewHTTPError(
-					http.StatusBadRequest,
-					fmt.Sprintf("another race with id %d is already running", currentRace.race.ID),
-				)
-			}
-			expectedState = BeforeStart
-		case Finished:
-			expectedState = Running
-		case Unfinished:
-			expectedState = Running
+		case Running, Paused, Finished, Unfinished:
 		default:
 			return echo.NewHTTPError(
 				http.StatusBadRequest,
 				fmt.Sprintf("unsupported state '%s'", string(state)),
 			)
 		}
-		if race.State != expectedState {
+		expected := false
+		expectedStates := make([]string, len(from))
+		for i, s := range from {
+			expected = expected || race.State == s
+			expectedStates[i] = "'" + string(s) + "'"
+		}
+		if !expected {
 			return echo.NewHTTPError(
 				http.StatusBadRequest,
 				fmt.Sprintf(
-					"state should be '%s', not '%s'",
-					string(expectedState), string(race.State),
+					"state should be %s, not '%s'",
+					strings.Join(expectedStates, " or "), string(race.State),
 				),
 			)
 		}
-		if err := tx.Model(&race).Updates(&Race{State: state}).Error; err != nil {
+		if state == Running && race.State == BeforeStart {
+			if other := currentRaces.conflicting(&race); other != nil {
+				return echo.NewHTTPError(
+					http.StatusBadRequest,
+					fmt.Sprintf("another race with id %d is already running on the same track or barriers", other.ID),
+				)
+			}
+		}
+		now := Time(time.Now())
+		if state == Paused {
+			if err := tx.Create(&RacePause{RaceID: race.ID, StartTime: now}).Error; err != nil {
+				return err
+			}
+		} else if race.State == Paused {
+			// close the pause interval
+			if err := tx.Model(&RacePause{}).Where("race_id = ? AND end_time IS NULL", race.ID).Update("end_time", now).Error; err != nil {
+				return err
+			}
+		}
+		update := Race{State: state}
+		switch {
+		case state == Running && race.State == BeforeStart:
+			update.StartedAt = &now
+		case state == Finished || state == Unfinished:
+			update.StoppedAt = &now
+			update.FinishReason = reason
+		}
+		before := raceStateAudit(&race)
+		if err := tx.Model(&race).Updates(&update).Error; err != nil {
+			return err
+		}
+		entry.Entity, entry.EntityID, entry.RaceID = "race", race.ID, race.ID
+		after := before
+		after.State = state
+		if update.StartedAt != nil {
+			after.StartedAt = update.StartedAt
+		}
+		if update.StoppedAt != nil {
+			after.StoppedAt, after.FinishReason = update.StoppedAt, update.FinishReason
+		}
+		entry.Before, entry.After = auditValue(before), auditValue(after)
+		if err := recordAudit(tx, entry); err != nil {
 			return err
 		}
-		// Database updates completed, update also currentRace.
+		// Database updates completed, update also currentRaces.
+		race.State = state
 		switch state {
-		case Running:
-			currentRace.race = &race
+		case Running, Paused:
+			currentRaces.set(&race)
 		case Finished:
-			currentRace.race = nil
+			currentRaces.remove(&race)
 		case Unfinished:
-			currentRace.race = nil
-		}
-		if b, err := json.Marshal(&currentRace); err == nil {
-			// TODO: Is it OK to send current race before
-			// the race itself or it should be vice versa?
-			hub.broadcast <- b
-		} else {
-			return fmt.Errorf("current race marshal error: %v", err)
+			currentRaces.remove(&race)
 		}
+		// TODO: Is it OK to send current races before
+		// the race itself or it should be vice versa?
+		hub.broadcastCurrentRaces <- currentRaces.snapshot()
 		return nil
 	})
 	if err != nil {
-		return err
+		return race, err
 	}
 	if err := broadcastRace(&race); err != nil {
-		return err
+		return race, err
 	}
-	return c.JSON(http.StatusOK, race)
+	return race, nil
 }
 
 func getAllTeams(c echo.Context) error {
 	var teams []Team
-	if err := db.Find(&teams).Error; err != nil {
+	query := db
+	if c.QueryParam("event_id") != "" {
+		var eventId uint
+		if err := echo.QueryParamsBinder(c).Uint("event_id", &eventId).BindError(); err != nil {
+			return err
+		}
+		// only teams registered to the event
+		query = query.Joins("JOIN event_teams ON event_teams.team_id = teams.id").
+			Where("event_teams.event_id = ?", eventId)
+	}
+	if err := query.Find(&teams).Error; err != nil {
 		return err
 	}
 	return c.JSON(http.StatusOK, teams)
@@ -194,6 +311,7 @@ func createTeam(c echo.Context) error {
 	if err := db.Create(&team).Error; err != nil {
 		return err
 	}
+	audit(c, "team", team.ID, 0, nil, team)
 	return c.JSON(http.StatusOK, team)
 }
 
@@ -202,15 +320,34 @@ func updateTeam(c echo.Context) error {
 	if err := c.Bind(&team); err != nil {
 		return err
 	}
+	var old Team
+	if err := db.First(&old, team.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(
+				http.StatusNotFound,
+				fmt.Sprintf("team with id %d not found", team.ID),
+			)
+		}
+		return err
+	}
 	if err := db.Updates(&team).Error; err != nil {
 		return err
 	}
+	// the request may not contain all fields
+	if err := db.First(&team, team.ID).Error; err != nil {
+		return err
+	}
+	audit(c, "team", team.ID, 0, old, team)
 	return c.JSON(http.StatusOK, team)
 }
 
 func getAllRaces(c echo.Context) error {
 	var races []Race
-	if err := db.Preload("TeamA").Preload("TeamB").Find(&races).Error; err != nil {
+	scope, err := eventScope(c)
+	if err != nil {
+		return err
+	}
+	if err := db.Scopes(scope).Preload("TeamA").Preload("TeamB").Find(&races).Error; err != nil {
 		return err
 	}
 	return c.JSON(http.StatusOK, races)
@@ -231,9 +368,29 @@ func createRace(c echo.Context) error {
 	// 		"round not specified or invalid (must be greater than 0)",
 	// 	)
 	// }
+	if race.EventID != 0 {
+		var event Event
+		if err := findEvent(race.EventID, &event); err != nil {
+			return err
+		}
+	}
 	if race.TeamAID == 0 {
 		return echo.NewHTTPError(http.StatusBadRequest, "teamAId not specified")
 	}
+	if err := validateFilter(race.DebounceTime, race.MinLapTime); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateAssignmentStrategy(race.AssignmentStrategy); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	track := &defaultTrack
+	if race.TrackID != nil {
+		t, err := findTrack(*race.TrackID)
+		if err != nil {
+			return err
+		}
+		track = &t
+	}
 	if err := db.Model(&race).Association("TeamA").Find(&race.TeamA); err != nil {
 		return err
 	}
@@ -279,23 +436,48 @@ func createRace(c echo.Context) error {
 				fmt.Sprintf("no team with id %d", race.TeamBID),
 			)
 		}
+		if track.TeamBLapBarrier == 0 {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("track %d has no lap barrier for team B", track.ID),
+			)
+		}
 		if race.LapsDuration == nil {
 			// TODO: Is this correct? Where will the variable be allocated?
 			var defaultLapsDuration uint = 10 // defaults to 10 laps
 			race.LapsDuration = &defaultLapsDuration
 		}
 	}
+	teamIds := []uint{race.TeamA.ID}
+	if race.TeamB != nil {
+		teamIds = append(teamIds, race.TeamB.ID)
+	}
+	for _, teamId := range teamIds {
+		if ok, err := isTeamRegistered(race.EventID, teamId); err != nil {
+			return err
+		} else if !ok {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("team with id %d is not registered to event %d", teamId, race.EventID),
+			)
+		}
+	}
 	// always force BeforeStart state
 	race.State = BeforeStart
-	if err := db.Omit("TeamA", "TeamB").Create(&race).Error; err != nil {
+	if err := db.Omit("TeamA", "TeamB", "Track").Create(&race).Error; err != nil {
 		return err
 	}
+	audit(c, "race", race.ID, race.ID, nil, race)
 	return c.JSON(http.StatusOK, &race)
 }
 
 func getFinishedRaces(c echo.Context) error {
 	var races []Race
-	if err := db.Where(&Race{State: Finished}).Preload("TeamA").Preload("TeamB").Find(&races).Error; err != nil {
+	scope, err := eventScope(c)
+	if err != nil {
+		return err
+	}
+	if err := db.Scopes(scope).Where(&Race{State: Finished}).Preload("TeamA").Preload("TeamB").Find(&races).Error; err != nil {
 		return err
 	}
 	return c.JSON(http.StatusOK, races)
@@ -324,15 +506,35 @@ func updateCrossing(c echo.Context) error {
 	}
 	err := db.Transaction(func(tx *gorm.DB) error {
 
+		reason := crossing.IgnoreReason
+		if update.Ignored != crossing.Ignored {
+			// the operator overrides the noise filter
+			reason = NotIgnored
+			if update.Ignored {
+				reason = IgnoredByOperator
+			}
+		}
+		before, after := crossing, crossing
+		after.Ignored, after.IgnoreReason, after.Team = update.Ignored, reason, update.Team
 		// note: we have to explicitly select Team otherwise GoORM will ignore zero fields
-		if err := db.Model(&crossing).Select("Ignored", "Team").Updates(Crossing{Ignored: update.Ignored, Team: update.Team}).Error; err != nil {
+		if err := tx.Model(&crossing).Select("Ignored", "IgnoreReason", "Team").Updates(Crossing{Ignored: update.Ignored, IgnoreReason: reason, Team: update.Team}).Error; err != nil {
 			return err
 		}
+		if err := auditTx(tx, c, "crossing", crossing.ID, crossing.RaceID, crossingAudit(&before), crossingAudit(&after)); err != nil {
+			return err
+		}
+
+		// the false start may now belong to the other team
+		if crossing.RaceID != 0 && crossing.FalseStart {
+			if err := updateFalseStarts(tx, crossing.RaceID); err != nil {
+				return err
+			}
+		}
 
 		// also update associated Race's (if any) UpdatedAt field
 		// so the frontend can find out what is the latest version
 		if crossing.RaceID != 0 {
-			if err := db.Model(&Race{}).Where("id = ?", crossing.RaceID).Update("UpdatedAt", time.Now()).Error; err != nil {
+			if err := tx.Model(&Race{}).Where("id = ?", crossing.RaceID).Update("UpdatedAt", time.Now()).Error; err != nil {
 				return err
 			}
 		}
@@ -349,12 +551,98 @@ func updateCrossing(c echo.Context) error {
 	return c.JSON(http.StatusOK, crossing)
 }
 
+// createCrossing adds a manual crossing to the race, e.g. when the
+// barrier missed the car.
+func createCrossing(c echo.Context) error {
+	var raceId uint
+	if err := echo.PathParamsBinder(c).MustUint("id", &raceId).BindError(); err != nil {
+		return err
+	}
+	var crossing Crossing
+	if err := c.Bind(&crossing); err != nil {
+		return err
+	}
+	var race Race
+	if err := findRace(raceId, &race, raceDetails); err != nil {
+		return err
+	}
+	if time.Time(crossing.Time).UnixMilli() <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "time not specified")
+	}
+	if race.Type == HeadToHead && crossing.Team != TeamA && crossing.Team != TeamB {
+		return echo.NewHTTPError(http.StatusBadRequest, "team value must be either 1 or 2 for head_to_head race")
+	}
+	if race.Type != HeadToHead && crossing.Team != TeamNotSet {
+		return echo.NewHTTPError(http.StatusBadRequest, "team value must be 0 for time_trial race")
+	}
+	if crossing.BarrierId == 0 {
+		crossing.BarrierId = race.track().lapBarrier(crossing.Team)
+	}
+	if race.track().barrier(crossing.BarrierId) == nil {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("barrier %d is not placed on the track of the race", crossing.BarrierId),
+		)
+	}
+	// the id path parameter is the race id
+	crossing = Crossing{
+		Time:       crossing.Time,
+		BarrierId:  crossing.BarrierId,
+		Team:       crossing.Team,
+		Paused:     pausedAt(race.Pauses, time.Time(crossing.Time)),
+		FalseStart: race.StartedAt != nil && time.Time(crossing.Time).Before(time.Time(*race.StartedAt)),
+		Manual:     true,
+		CreatedBy:  auditActor(c),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// this also updates Race's UpdatedAt so the frontend can
+		// find out what is the latest version
+		if err := tx.Model(&Race{CommonModelFields: CommonModelFields{ID: race.ID}}).Association("Crossings").Append(&crossing); err != nil {
+			return err
+		}
+		if err := auditTx(tx, c, "crossing", crossing.ID, race.ID, nil, crossingAudit(&crossing)); err != nil {
+			return err
+		}
+		if crossing.FalseStart {
+			return updateFalseStarts(tx, race.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := broadcastRace(&race); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, crossing)
+}
+
+// updateFalseStarts recomputes the false start flags of the race from
+// its (not ignored) crossings.
+func updateFalseStarts(tx *gorm.DB, raceId uint) error {
+	var teams []CrossingTeam
+	if err := tx.Model(&Crossing{}).
+		Where("race_id = ? AND false_start = ? AND ignored = ?", raceId, true, false).
+		Distinct().Pluck("team", &teams).Error; err != nil {
+		return err
+	}
+	flags := map[string]interface{}{"team_a_false_start": false, "team_b_false_start": false}
+	for _, team := range teams {
+		if team == TeamB {
+			flags["team_b_false_start"] = true
+		} else {
+			flags["team_a_false_start"] = true
+		}
+	}
+	return tx.Model(&Race{}).Where("id = ?", raceId).Updates(flags).Error
+}
+
 func initDb() *gorm.DB {
 	db, err := gorm.Open(sqlite.Open("scoreapp.db"), &gorm.Config{})
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = db.AutoMigrate(&Team{}, &Race{}, &Crossing{})
+	err = db.AutoMigrate(&Team{}, &Event{}, &Track{}, &TrackBarrier{}, &Race{}, &RacePause{}, &Penalty{}, &Crossing{}, &Car{}, &AuditEntry{}, &User{}, &Session{}, &RegisteredBarrier{}, &Detection{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -372,15 +660,16 @@ func initDb() *gorm.DB {
 	// Find running races
 	var races []Race
 
-	if err := db.Where(&Race{State: Running}).Find(&races).Error; err != nil {
+	if err := db.Preload("Track.Barriers").Where("state IN ?", activeRaceStates).Find(&races).Error; err != nil {
 		log.Panicf("error finding running races: %v\n", err)
 	} else {
-		if len(races) > 1 {
-			log.Printf("Warning: %d running races", len(races))
-		}
-		if len(races) > 0 && races[0].ID != 0 {
-			currentRace.race = &races[0]
-			log.Printf("Running race: #%d", races[0].ID)
+		for i := range races {
+			if other := currentRaces.conflicting(&races[i]); other != nil {
+				log.Printf("Warning: race #%d conflicts with running race #%d", races[i].ID, other.ID)
+				continue
+			}
+			currentRaces.set(&races[i])
+			log.Printf("Running race: #%d", races[i].ID)
 		}
 	}
 	return db
@@ -388,18 +677,20 @@ func initDb() *gorm.DB {
 
 func broadcastRace(race *Race) error {
 	type Message struct {
-		Race *Race `json:"race"`
+		Race  *Race      `json:"race"`
+		Stats *RaceStats `json:"stats"`
 	}
 
 	var fullRace Race
-	if err := db.Model(&Race{}).Preload("Crossings").Preload("TeamA").Preload("TeamB").First(&fullRace, race.ID).Error; err != nil {
+	if err := db.Model(&Race{}).Scopes(raceDetails).Preload("TeamA").Preload("TeamB").First(&fullRace, race.ID).Error; err != nil {
 		return err
 	}
-	b, err := json.Marshal(&Message{&fullRace})
+	stats := computeRaceStats(&fullRace)
+	b, err := json.Marshal(&Message{&fullRace, &stats})
 	if err != nil {
 		return err
 	}
-	hub.broadcast <- b
+	hub.broadcastScoped <- ScopedMessage{EventId: fullRace.EventID, Message: b}
 	return nil
 }
 
@@ -408,7 +699,9 @@ func barrierSimulator(hub *Hub, db *gorm.DB) {
 	var barrierId uint = 1
 	for {
 		var race Race
-		if err := db.Last(&race, "state = ?", Running).Error; err != nil {
+		if raceId := currentRaces.forBarrier(barrierId); raceId == 0 {
+			log.Printf("could not generate new crossing because: there is no race")
+		} else if err := db.First(&race, "id = ? AND state = ?", raceId, Running).Error; err != nil {
 			log.Printf("could not generate new crossing because: %s", err)
 		} else if race.ID == 0 {
 			log.Printf("could not generate new crossing because: there is no race")
@@ -439,45 +732,39 @@ func barrierWebsockHandler(c echo.Context) error {
 		return err
 	}
 
-	if len(keys) > 0 {
-		key, ok := keys[c.Request().URL.Path]
-		if !ok {
-			return echo.NewHTTPError(
-				http.StatusUnauthorized,
-				fmt.Sprintf("no key configured for %s", c.Request().URL.Path),
-			)
-		}
-		if c.Request().Header.Get(echo.HeaderAuthorization) != key {
-			return echo.NewHTTPError(http.StatusUnauthorized, "invalid key")
-		}
+	if err := authorizeBarrier(c, id); err != nil {
+		return err
 	}
-	barrier := &Barrier{Id: id, hub: hub, RegistrationOk: make(chan bool)}
+
+	// A new connection replaces the existing one of the barrier unless
+	// the existing one still answers pings (see Hub.run)
+	barrier := newBarrier(id, hub)
 	hub.registerBarrier <- barrier
-	if ok := <-barrier.RegistrationOk; !ok {
-		return echo.NewHTTPError(http.StatusBadRequest, "barrier already connected")
+	registration := <-barrier.registered
+	if registration.err != nil {
+		return echo.NewHTTPError(http.StatusConflict, registration.err.Error())
 	}
-
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
+		hub.unregisterBarrier <- barrier
 		return err
 	}
-
+	if registration.previous != nil {
+		// the replaced reader must stop storing detections first
+		<-registration.previous.done
+	}
 	go barrier.reader(ws)
 	return nil
 }
 
-func checkKey(key string, c echo.Context) (bool, error) {
-	if postKey, ok := keys["POST"]; ok {
-		return key == postKey, nil
-	} else {
-		return false, fmt.Errorf("no POST key configured")
-	}
-}
-
 func main() {
 	sim := flag.Bool("sim", false, "Simulate barrier")
 	loopback := flag.Bool("loopback", false, "Listen only on lo interface (127.0.0.1)")
-	keysFile := flag.String("keys", "", "File with JSON-encoded API keys")
+	keysFile := flag.String("keys", "", "File with JSON-encoded API keys (POST key and barrier keys, which are imported to the barrier registry)")
+	private := flag.Bool("private", false, "Require login (viewer role) for reading data")
+	adminName := flag.String("create-admin", "", "Create admin with this name and password from SCOREAPP_ADMIN_PASSWORD")
+	flag.DurationVar(&timeTolerance, "time-tolerance", timeTolerance, "Quarantine detections with timestamps differing from the backend time by more than this value")
+	flag.DurationVar(&maxClockOffset, "max-clock-offset", maxClockOffset, "Warn when barrier clock offset exceeds this value")
 	flag.Parse()
 
 	if *keysFile != "" {
@@ -515,23 +802,24 @@ func main() {
 		// Allow browsers to cache preflight requests for 1 hour.
 		MaxAge: 3600,
 	}))
-	if len(keys) > 0 {
-		// Check auth. key for all POST requests. Barrier keys (GET)
-		// are checked in barrierWebsockHandler.
-		e.Use(middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
-			Skipper: func(c echo.Context) bool {
-				// No auth for GET requests
-				return c.Request().Method == "GET"
-			},
-			Validator: checkKey,
-		}))
-	}
+	// Identify users logged in via /login or requests with the POST
+	// key. Barrier keys are checked in barrierWebsockHandler against
+	// the barrier registry.
+	e.Use(authMiddleware(*private))
+	// Record changes not recorded by the handlers in the audit log
+	e.Use(auditMiddleware)
 
 	db = initDb()
+	importBarrierKeys(keys)
+	if *adminName != "" {
+		createAdmin(*adminName)
+	}
 
 	hub = newHub()
 	go hub.run()
 
+	go raceSupervisor()
+
 	if *sim {
 		go barrierSimulator(hub, db)
 	}
@@ -539,17 +827,61 @@ func main() {
 	e.GET("/", func(c echo.Context) error { return c.String(http.StatusOK, "F1tenth ScoreApp works!") })
 	e.GET("/ws", func(c echo.Context) error { return websockHandler(c, hub) })
 	e.GET("/barrier/:id", barrierWebsockHandler)
+	e.POST("/login", login)
+	e.POST("/logout", logout)
+	e.GET("/users", getAllUsers, requireRole(Admin))
+	e.POST("/users", createUser, requireRole(Admin))
+	e.POST("/users/:id", updateUser, requireRole(Admin))
+	e.POST("/users/:id/delete", deleteUser, requireRole(Admin))
+	e.GET("/barriers", getBarriers)
+	e.GET("/barriers/registry", getRegisteredBarriers)
+	e.POST("/barriers", registerBarrier, requireRole(Admin))
+	e.POST("/barriers/:id", updateRegisteredBarrier, requireRole(Admin))
+	e.POST("/barriers/:id/key", rotateBarrierKey, requireRole(Admin))
+	e.POST("/barriers/:id/disconnect", disconnectBarrier, requireRole(Admin))
+	e.GET("/audit", getAudit, requireRole(Viewer))
+	e.GET("/cars", getAllCars)
+	e.POST("/cars", createCar, requireRole(Admin))
+	e.POST("/cars/:id", updateCar, requireRole(Admin))
+	e.POST("/cars/:id/delete", deleteCar, requireRole(Admin))
 	e.GET("/teams", getAllTeams)
-	e.POST("/teams", createTeam)
-	e.POST("/teams/:id", updateTeam)
+	e.POST("/teams", createTeam, requireRole(Admin))
+	e.POST("/teams/:id", updateTeam, requireRole(Admin))
 	e.GET("/races", getAllRaces)
-	e.POST("/races", createRace)
+	e.POST("/races", createRace, requireRole(RaceControl))
 	e.GET("/races/:id", getRace)
-	e.POST("/races/:id/start", func(c echo.Context) error { return setRaceState(c, Running) })
-	e.POST("/races/:id/stop", func(c echo.Context) error { return setRaceState(c, Finished) })
-	e.POST("/races/:id/cancel", func(c echo.Context) error { return setRaceState(c, Unfinished) })
+	e.GET("/races/:id/stats", getRaceStats)
+	e.GET("/races/:id/sensors", getRaceSensors)
+	e.POST("/races/:id/start", func(c echo.Context) error { return setRaceState(c, Running, BeforeStart) }, requireRole(RaceControl))
+	e.POST("/races/:id/pause", func(c echo.Context) error { return setRaceState(c, Paused, Running) }, requireRole(RaceControl))
+	e.POST("/races/:id/resume", func(c echo.Context) error { return setRaceState(c, Running, Paused) }, requireRole(RaceControl))
+	// paused races can be stopped as well
+	e.POST("/races/:id/stop", func(c echo.Context) error { return setRaceState(c, Finished, activeRaceStates...) }, requireRole(RaceControl))
+	e.POST("/races/:id/cancel", func(c echo.Context) error { return setRaceState(c, Unfinished, activeRaceStates...) }, requireRole(RaceControl))
+	e.POST("/races/:id/undo", func(c echo.Context) error { return undoRaceChange(c, false) }, requireRole(Timing))
+	e.POST("/races/:id/redo", func(c echo.Context) error { return undoRaceChange(c, true) }, requireRole(Timing))
 	e.GET("/races/finished", getFinishedRaces)
-	e.POST("/crossings/:id", updateCrossing)
+	e.POST("/crossings/:id", updateCrossing, requireRole(Timing))
+	e.POST("/races/:id/crossings", createCrossing, requireRole(Timing))
+	e.GET("/crossings/orphaned", getOrphanedCrossings)
+	e.GET("/crossings/quarantined", getQuarantinedCrossings)
+	e.POST("/crossings/:id/release", releaseCrossing, requireRole(Timing))
+	e.POST("/races/:id/crossings/attach", attachCrossings, requireRole(Timing))
+	e.GET("/races/:id/penalties", getRacePenalties)
+	e.POST("/races/:id/penalties", createPenalty, requireRole(RaceControl))
+	e.POST("/penalties/:id", updatePenalty, requireRole(RaceControl))
+	e.POST("/penalties/:id/delete", deletePenalty, requireRole(RaceControl))
+	e.GET("/standings", getStandings)
+	e.GET("/tracks", getAllTracks)
+	e.POST("/tracks", createTrack, requireRole(Admin))
+	e.GET("/tracks/:id", getTrackHandler)
+	e.POST("/tracks/:id", updateTrack, requireRole(Admin))
+	e.GET("/events", getAllEvents)
+	e.POST("/events", createEvent, requireRole(Admin))
+	e.GET("/events/:id", getEvent)
+	e.POST("/events/:id", updateEvent, requireRole(Admin))
+	e.POST("/events/:id/teams", func(c echo.Context) error { return registerTeam(c, true) }, requireRole(Admin))
+	e.POST("/events/:id/teams/:team_id/unregister", func(c echo.Context) error { return registerTeam(c, false) }, requireRole(Admin))
 
 	var host string = ""
 	if *loopback {
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupTestDb replaces the global database by an empty one and resets
+// the keys, the current races and the hub
+func setupTestDb(t *testing.T) {
+	t.Helper()
+	var err error
+	db, err = gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&Team{}, &Event{}, &Track{}, &TrackBarrier{}, &Race{}, &RacePause{}, &Penalty{}, &Crossing{}, &Car{}, &AuditEntry{}, &User{}, &Session{}, &RegisteredBarrier{}, &Detection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = nil
+	currentRaces = CurrentRaces{}
+	hub = newHub()
+	go hub.run()
+}
+
+// startTestRace stores the race and makes it current
+func startTestRace(t *testing.T, race *Race) {
+	t.Helper()
+	if race.State == "" {
+		race.State = Running
+	}
+	if err := db.Create(race).Error; err != nil {
+		t.Fatal(err)
+	}
+	currentRaces.set(race)
+}
+
+// jsonRequest returns a request with the JSON body
+func jsonRequest(method, body string) *http.Request {
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return req
+}
+
+// callHandler calls the handler with the request and the id path
+// parameter (if not 0)
+func callHandler(handler echo.HandlerFunc, req *http.Request, id uint) (*httptest.ResponseRecorder, error) {
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	if id != 0 {
+		c.SetParamNames("id")
+		c.SetParamValues(strconv.FormatUint(uint64(id), 10))
+	}
+	return rec, handler(c)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Crossings stored when no race was running on the barrier's track
+// (e.g. because the operator started the race late) have RaceID 0.
+
+// OrphanWindow selects orphaned crossings by their time (milliseconds
+// since epoch, both optional) and barrier
+type OrphanWindow struct {
+	From      int64 `json:"from" query:"from"`
+	To        int64 `json:"to" query:"to"`
+	BarrierId uint  `json:"barrierId" query:"barrier_id"`
+}
+
+func (w *OrphanWindow) scope(tx *gorm.DB) *gorm.DB {
+	tx = tx.Where("race_id = ?", 0).Scopes(notQuarantined)
+	if w.From != 0 {
+		tx = tx.Where("time >= ?", time.UnixMilli(w.From))
+	}
+	if w.To != 0 {
+		tx = tx.Where("time <= ?", time.UnixMilli(w.To))
+	}
+	if w.BarrierId != 0 {
+		tx = tx.Where("barrier_id = ?", w.BarrierId)
+	}
+	return tx
+}
+
+func getOrphanedCrossings(c echo.Context) error {
+	var window OrphanWindow
+	if err := c.Bind(&window); err != nil {
+		return err
+	}
+	var crossings []Crossing
+	if err := db.Scopes(window.scope).Order("time").Find(&crossings).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, crossings)
+}
+
+// attachCrossings attaches orphaned crossings selected by their IDs or
+// by a time window to the race. Only crossings of barriers placed on
+// the race's track are attached. Teams of head-to-head crossings are
+// assigned and the noise filter is applied in time order as if the
+// crossings were just detected. Crossings before the official start
+// are false starts unless the request sets noFalseStarts (e.g. when
+// the race was started late).
+func attachCrossings(c echo.Context) error {
+	var raceId uint
+	if err := echo.PathParamsBinder(c).MustUint("id", &raceId).BindError(); err != nil {
+		return err
+	}
+	var req struct {
+		OrphanWindow
+		CrossingIds   []uint `json:"crossingIds"`
+		NoFalseStarts bool   `json:"noFalseStarts"`
+	}
+	if err := (&echo.DefaultBinder{}).BindBody(c, &req); err != nil {
+		return err
+	}
+	if len(req.CrossingIds) == 0 && req.From == 0 && req.To == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "crossingIds or from/to not specified")
+	}
+	var race Race
+	if err := findRace(raceId, &race, raceDetails); err != nil {
+		return err
+	}
+	// crossings of grouped barriers are merged as when they are detected
+	defer lockGroups(race.track().groups()...)()
+	var crossings []Crossing
+	err := db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Scopes(req.OrphanWindow.scope)
+		if len(req.CrossingIds) > 0 {
+			query = query.Where("id IN ?", req.CrossingIds)
+		}
+		if err := query.Order("time").Order("id").Find(&crossings).Error; err != nil {
+			return err
+		}
+		attached := crossings[:0]
+		mergedCnt := 0
+		for i := range crossings {
+			crossing := &crossings[i]
+			if race.track().barrier(crossing.BarrierId) == nil {
+				continue
+			}
+			before := *crossing
+			merged, err := fuseAttachedCrossing(tx, &race, crossing)
+			if err != nil {
+				return err
+			}
+			if merged {
+				if err := auditTx(tx, c, "crossing", crossing.ID, race.ID, crossingAudit(&before), nil); err != nil {
+					return err
+				}
+				mergedCnt++
+				continue
+			}
+			crossing.RaceID = race.ID
+			crossing.Paused = pausedAt(race.Pauses, time.Time(crossing.Time))
+			crossing.FalseStart = !req.NoFalseStarts && race.StartedAt != nil && time.Time(crossing.Time).Before(time.Time(*race.StartedAt))
+			if race.Type == HeadToHead {
+				var err error
+				if crossing.Team, err = race.teamAssigner().assignTeam(tx, &race, crossing); err != nil {
+					return err
+				}
+				if crossing.CarId != "" {
+					if err := assignCarTeam(tx, &race, crossing); err != nil {
+						return err
+					}
+				}
+			}
+			if !crossing.Ignored {
+				if crossing.IgnoreReason, err = autoIgnoreReason(tx, &race, crossing); err != nil {
+					return err
+				}
+				crossing.Ignored = crossing.IgnoreReason != NotIgnored
+			}
+			// select all fields otherwise GoORM will ignore zero fields
+			err = tx.Model(crossing).Select("RaceID", "Paused", "FalseStart", "Team", "TeamMismatch", "Ignored", "IgnoreReason").Updates(crossing).Error
+			if err != nil {
+				return err
+			}
+			if err := auditTx(tx, c, "crossing", crossing.ID, race.ID, crossingAudit(&before), crossingAudit(crossing)); err != nil {
+				return err
+			}
+			attached = append(attached, *crossing)
+		}
+		crossings = attached
+		if len(crossings)+mergedCnt == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("no orphaned crossings of race %d barriers selected", race.ID))
+		}
+		if err := updateFalseStarts(tx, race.ID); err != nil {
+			return err
+		}
+		// so the frontend can find out what is the latest version
+		return tx.Model(&Race{}).Where("id = ?", race.ID).Update("UpdatedAt", time.Now()).Error
+	})
+	if err != nil {
+		return err
+	}
+	if err := broadcastRace(&race); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, crossings)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// storeOrphans stores crossings of no race at the given times
+func storeOrphans(t *testing.T, barrierId uint, times ...time.Duration) []uint {
+	t.Helper()
+	var ids []uint
+	for _, c := range testCrossings(barrierId, TeamNotSet, times...) {
+		if err := db.Create(&c).Error; err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// testClient registers a websocket client without connection to the
+// hub, so that the test can receive broadcast messages
+func testClient() *Client {
+	client := &Client{hub: hub, send: make(chan []byte, 16)}
+	hub.registerClient <- client
+	return client
+}
+
+// receiveRace returns the next race broadcast to the client
+func receiveRace(t *testing.T, client *Client) Race {
+	t.Helper()
+	for {
+		select {
+		case b := <-client.send:
+			var msg struct {
+				Race *Race `json:"race"`
+			}
+			if err := json.Unmarshal(b, &msg); err == nil && msg.Race != nil {
+				return *msg.Race
+			}
+		case <-time.After(time.Second):
+			t.Fatal("race not broadcast")
+		}
+	}
+}
+
+func TestAttachCrossings(t *testing.T) {
+	tests := []struct {
+		name          string
+		noFalseStarts bool
+		falseStart    bool
+	}{
+		{"false start", false, true},
+		{"race started late", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDb(t)
+			startedAt := Time(at(10 * time.Second))
+			race := Race{Type: TimeTrial, StartedAt: &startedAt}
+			startTestRace(t, &race)
+			// stored before the race was started, one before and
+			// one after its official start
+			ids := storeOrphans(t, 1, 5*time.Second, 15*time.Second)
+			// barrier which is not on the track of the race
+			ids = append(ids, storeOrphans(t, 99, 15*time.Second)...)
+			client := testClient()
+
+			body := fmt.Sprintf(`{"crossingIds": [%d, %d, %d], "noFalseStarts": %v}`, ids[0], ids[1], ids[2], tt.noFalseStarts)
+			rec, err := callHandler(attachCrossings, jsonRequest(http.MethodPost, body), race.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var attached []Crossing
+			if err := json.Unmarshal(rec.Body.Bytes(), &attached); err != nil {
+				t.Fatal(err)
+			}
+			if len(attached) != 2 || attached[0].ID != ids[0] || attached[1].ID != ids[1] {
+				t.Fatalf("attached %+v, want crossings %v", attached, ids[:2])
+			}
+			if attached[0].FalseStart != tt.falseStart || attached[1].FalseStart {
+				t.Errorf("false starts = %v, %v, want %v, false", attached[0].FalseStart, attached[1].FalseStart, tt.falseStart)
+			}
+
+			rec, err = callHandler(getRace, jsonRequest(http.MethodGet, ""), race.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Race
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.TeamAFalseStart != tt.falseStart || len(got.Crossings) != 2 {
+				t.Errorf("race teamAFalseStart = %v with %d crossings, want %v with 2 crossings",
+					got.TeamAFalseStart, len(got.Crossings), tt.falseStart)
+			}
+			if broadcast := receiveRace(t, client); broadcast.TeamAFalseStart != tt.falseStart {
+				t.Errorf("broadcast teamAFalseStart = %v, want %v", broadcast.TeamAFalseStart, tt.falseStart)
+			}
+
+			// the orphan left is not attached again
+			if _, err := callHandler(attachCrossings, jsonRequest(http.MethodPost, body), race.ID); err == nil {
+				t.Errorf("attaching no orphans succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// RacePause is an interval during which the race was paused (e.g.
+// after a crash). Paused time is not counted in lap times and extends
+// the time limit of time trials.
+type RacePause struct {
+	ID        uint  `gorm:"primaryKey" json:"-"`
+	RaceID    uint  `gorm:"index" json:"-"`
+	StartTime Time  `json:"start"`
+	EndTime   *Time `json:"end,omitempty"` // nil while the race is paused
+}
+
+// interval returns start and end of the pause. Pauses which have not
+// ended yet end now.
+func (p *RacePause) interval() (time.Time, time.Time) {
+	if p.EndTime == nil {
+		return time.Time(p.StartTime), time.Now()
+	}
+	return time.Time(p.StartTime), time.Time(*p.EndTime)
+}
+
+// pausedAt returns true if the race was paused at time t.
+func pausedAt(pauses []RacePause, t time.Time) bool {
+	for i := range pauses {
+		start, end := pauses[i].interval()
+		if !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// pausedDuration returns how long the race was paused between from and to.
+func pausedDuration(pauses []RacePause, from, to time.Time) time.Duration {
+	var paused time.Duration
+	for i := range pauses {
+		start, end := pauses[i].interval()
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			paused += end.Sub(start)
+		}
+	}
+	return paused
+}
+
+// extendByPauses returns the time when a race started at start and
+// limited to duration ends, when the paused time is not counted.
+func extendByPauses(pauses []RacePause, start time.Time, duration time.Duration) time.Time {
+	sorted := make([]RacePause, len(pauses))
+	copy(sorted, pauses)
+	sort.Slice(sorted, func(i, j int) bool {
+		return time.Time(sorted[i].StartTime).Before(time.Time(sorted[j].StartTime))
+	})
+	stop := start.Add(duration)
+	for i := range sorted {
+		pauseStart, pauseEnd := sorted[i].interval()
+		if pauseStart.Before(start) {
+			pauseStart = start
+		}
+		if !pauseStart.Before(stop) {
+			break
+		}
+		if pauseEnd.After(pauseStart) {
+			stop = stop.Add(pauseEnd.Sub(pauseStart))
+		}
+	}
+	return stop
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testPause(start, end time.Duration) RacePause {
+	endTime := Time(at(end))
+	return RacePause{StartTime: Time(at(start)), EndTime: &endTime}
+}
+
+func TestPausedAt(t *testing.T) {
+	pauses := []RacePause{testPause(5*time.Second, 10*time.Second)}
+	tests := []struct {
+		name string
+		t    time.Duration
+		want bool
+	}{
+		{"before", 4 * time.Second, false},
+		{"start", 5 * time.Second, true},
+		{"inside", 7 * time.Second, true},
+		{"end", 10 * time.Second, false},
+		{"after", 11 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pausedAt(pauses, at(tt.t)); got != tt.want {
+				t.Errorf("pausedAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPausedDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		pauses   []RacePause
+		from, to time.Duration
+		want     time.Duration
+	}{
+		{"no pauses", nil, 0, 10 * time.Second, 0},
+		{"inside", []RacePause{testPause(2*time.Second, 5*time.Second)}, 0, 10 * time.Second, 3 * time.Second},
+		{"overlapping from", []RacePause{testPause(-2*time.Second, 3*time.Second)}, 0, 10 * time.Second, 3 * time.Second},
+		{"overlapping to", []RacePause{testPause(8*time.Second, 15*time.Second)}, 0, 10 * time.Second, 2 * time.Second},
+		{"outside", []RacePause{testPause(11*time.Second, 15*time.Second)}, 0, 10 * time.Second, 0},
+		{"several", []RacePause{
+			testPause(1*time.Second, 2*time.Second),
+			testPause(4*time.Second, 7*time.Second),
+		}, 0, 10 * time.Second, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pausedDuration(tt.pauses, at(tt.from), at(tt.to)); got != tt.want {
+				t.Errorf("pausedDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtendByPauses(t *testing.T) {
+	tests := []struct {
+		name     string
+		pauses   []RacePause
+		duration time.Duration
+		want     time.Duration
+	}{
+		{"no pauses", nil, 10 * time.Second, 10 * time.Second},
+		{"pause before start", []RacePause{testPause(-5*time.Second, -1*time.Second)}, 10 * time.Second, 10 * time.Second},
+		{"pause overlapping start", []RacePause{testPause(-5*time.Second, 2*time.Second)}, 10 * time.Second, 12 * time.Second},
+		{"pause inside", []RacePause{testPause(3*time.Second, 5*time.Second)}, 10 * time.Second, 12 * time.Second},
+		{"pause after stop", []RacePause{testPause(10*time.Second, 15*time.Second)}, 10 * time.Second, 10 * time.Second},
+		{"pause within extension", []RacePause{
+			// unsorted on purpose
+			testPause(11*time.Second, 12*time.Second),
+			testPause(5*time.Second, 7*time.Second),
+		}, 10 * time.Second, 13 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extendByPauses(tt.pauses, testStart, tt.duration); !got.Equal(at(tt.want)) {
+				t.Errorf("extendByPauses() = %v, want %v", got.Sub(testStart), tt.want)
+			}
+		})
+	}
+}
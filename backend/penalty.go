@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+type PenaltyKind string
+
+const (
+	// Laps are deducted from the number of laps of the team
+	LapDeduction PenaltyKind = "lap_deduction"
+	// Time is added to the race time of the team and to its best lap
+	// time, by which time trials are ranked
+	TimeAddition PenaltyKind = "time_addition"
+	// The team is disqualified from the race
+	Disqualification PenaltyKind = "disqualification"
+)
+
+// SQL interface
+
+func (e *PenaltyKind) Scan(value interface{}) error {
+	*e = PenaltyKind(value.(string))
+	return nil
+}
+
+func (e PenaltyKind) Value() (driver.Value, error) {
+	return string(e), nil
+}
+
+type Penalty struct {
+	CommonModelFields
+	RaceID uint         `gorm:"index" json:"raceId"`
+	Team   CrossingTeam `json:"team"` // TeamNotSet for time trials
+	Kind   PenaltyKind  `json:"kind"`
+	Laps   uint         `json:"laps,omitempty"` // if Kind == LapDeduction
+	Time   Duration     `json:"time,omitempty"` // if Kind == TimeAddition
+	Reason string       `json:"reason"`
+	// Operator who issued the penalty (see auditActor)
+	IssuedBy string `json:"issuedBy"`
+}
+
+// penaltyTeam returns the team slot used in race stats for the
+// penalties of the given team.
+func penaltyTeam(race *Race, team CrossingTeam) CrossingTeam {
+	if race.Type != HeadToHead {
+		return TeamNotSet
+	}
+	return team
+}
+
+// applyPenalties applies race penalties of the team to its stats.
+func applyPenalties(race *Race, team CrossingTeam, stats *TeamStats) {
+	var penaltyTime time.Duration
+	for _, p := range race.Penalties {
+		if penaltyTeam(race, p.Team) != team {
+			continue
+		}
+		switch p.Kind {
+		case LapDeduction:
+			stats.PenaltyLaps += p.Laps
+		case TimeAddition:
+			penaltyTime += time.Duration(p.Time)
+		case Disqualification:
+			stats.Disqualified = true
+		}
+	}
+	stats.PenaltyTime = Duration(penaltyTime)
+	if stats.PenaltyLaps < stats.NumLaps {
+		stats.TotalLaps = stats.NumLaps - stats.PenaltyLaps
+	}
+	if stats.BestLapTime != nil {
+		adjusted := *stats.BestLapTime + stats.PenaltyTime
+		stats.AdjustedBestLapTime = &adjusted
+	}
+	if stats.TotalLaps > 0 {
+		// laps deducted by penalties are the last ones
+		end := crossingTime(race, stats.Laps[stats.TotalLaps-1].CrossingID)
+		start := time.Time(*stats.StartTime)
+		if race.StartedAt != nil {
+			start = time.Time(*race.StartedAt)
+		}
+		total := Duration(end.Sub(start) - pausedDuration(race.Pauses, start, end) + penaltyTime)
+		stats.TotalTime = &total
+	}
+}
+
+func (p *Penalty) validate(race *Race) error {
+	switch p.Kind {
+	case LapDeduction:
+		if p.Laps == 0 {
+			return fmt.Errorf("laps not specified for lap_deduction penalty")
+		}
+	case TimeAddition:
+		if p.Time <= 0 {
+			return fmt.Errorf("time not specified for time_addition penalty")
+		}
+	case Disqualification:
+	default:
+		return fmt.Errorf("unsupported penalty kind '%s'", string(p.Kind))
+	}
+	if race.Type == HeadToHead && p.Team != TeamA && p.Team != TeamB {
+		return fmt.Errorf("team value must be either 1 or 2 for head_to_head race")
+	}
+	if race.Type != HeadToHead && p.Team != TeamNotSet {
+		return fmt.Errorf("team value must be 0 for time_trial race")
+	}
+	return nil
+}
+
+func findPenalty(id uint, penalty *Penalty) error {
+	if err := db.First(penalty, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(
+				http.StatusNotFound,
+				fmt.Sprintf("penalty with id %d not found", id),
+			)
+		}
+		return err
+	}
+	return nil
+}
+
+// savePenalty runs fn in a transaction, updates UpdatedAt of the race
+// so the frontend can find out what is the latest version and
+// broadcasts the race.
+func savePenalty(raceId uint, fn func(tx *gorm.DB) error) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Model(&Race{}).Where("id = ?", raceId).Update("UpdatedAt", time.Now()).Error
+	})
+	if err != nil {
+		return err
+	}
+	return broadcastRace(&Race{CommonModelFields: CommonModelFields{ID: raceId}})
+}
+
+func getRacePenalties(c echo.Context) error {
+	var race Race
+	if err := c.Bind(&race); err != nil {
+		return err
+	}
+	if err := findRace(race.ID, &race); err != nil {
+		return err
+	}
+	var penalties []Penalty
+	if err := db.Where("race_id = ?", race.ID).Find(&penalties).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, penalties)
+}
+
+func createPenalty(c echo.Context) error {
+	var raceId uint
+	if err := echo.PathParamsBinder(c).MustUint("id", &raceId).BindError(); err != nil {
+		return err
+	}
+	var penalty Penalty
+	if err := c.Bind(&penalty); err != nil {
+		return err
+	}
+	var race Race
+	if err := findRace(raceId, &race); err != nil {
+		return err
+	}
+	// the id path parameter is the race id
+	penalty.ID = 0
+	penalty.RaceID = race.ID
+	penalty.IssuedBy = auditActor(c)
+	if err := penalty.validate(&race); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	err := savePenalty(race.ID, func(tx *gorm.DB) error {
+		if err := tx.Create(&penalty).Error; err != nil {
+			return err
+		}
+		return auditTx(tx, c, "penalty", penalty.ID, race.ID, nil, penalty)
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, penalty)
+}
+
+func updatePenalty(c echo.Context) error {
+	var penalty Penalty
+	if err := c.Bind(&penalty); err != nil {
+		return err
+	}
+	var old Penalty
+	if err := findPenalty(penalty.ID, &old); err != nil {
+		return err
+	}
+	var race Race
+	if err := findRace(old.RaceID, &race); err != nil {
+		return err
+	}
+	penalty.RaceID, penalty.IssuedBy = old.RaceID, old.IssuedBy
+	if err := penalty.validate(&race); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	err := savePenalty(race.ID, func(tx *gorm.DB) error {
+		before := old
+		// note: select all fields otherwise GoORM will ignore zero fields
+		if err := tx.Model(&old).Select("Team", "Kind", "Laps", "Time", "Reason").Updates(&penalty).Error; err != nil {
+			return err
+		}
+		return auditTx(tx, c, "penalty", penalty.ID, race.ID, before, penalty)
+	})
+	if err != nil {
+		return err
+	}
+	if err := findPenalty(penalty.ID, &penalty); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, penalty)
+}
+
+func deletePenalty(c echo.Context) error {
+	var penalty Penalty
+	if err := c.Bind(&penalty); err != nil {
+		return err
+	}
+	if err := findPenalty(penalty.ID, &penalty); err != nil {
+		return err
+	}
+	err := savePenalty(penalty.RaceID, func(tx *gorm.DB) error {
+		if err := tx.Delete(&penalty).Error; err != nil {
+			return err
+		}
+		return auditTx(tx, c, "penalty", penalty.ID, penalty.RaceID, penalty, nil)
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, penalty)
+}
@@ -9,10 +9,23 @@ type RaceState string
 const (
 	BeforeStart RaceState = "before_start"
 	Running     RaceState = "running"
+	Paused      RaceState = "paused"
 	Finished    RaceState = "finished"
 	Unfinished  RaceState = "unfinished"
 )
 
+// FinishReason records what ended the race
+type FinishReason string
+
+const (
+	FinishedByOperator  FinishReason = "operator"
+	FinishedByTimeLimit FinishReason = "time_limit"
+	FinishedByLapLimit  FinishReason = "lap_limit"
+)
+
+// States of the current race, i.e. the race receiving crossings
+var activeRaceStates = []RaceState{Running, Paused}
+
 // SQL interface
 
 func (e *RaceState) Scan(value interface{}) error {
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// LapStats describes one completed lap, i.e. the time between two
+// consecutive (non-ignored) crossings of the team's lap barrier.
+type LapStats struct {
+	// ID of the crossing that completed the lap
+	CrossingID uint     `json:"crossingId"`
+	Number     uint     `json:"number"`
+	Time       Duration `json:"time"`
+}
+
+// CheckpointStats describes a partial lap time measured at a non-lap
+// barrier, relative to the start of the current lap.
+type CheckpointStats struct {
+	CrossingID uint     `json:"crossingId"`
+	LapNumber  uint     `json:"lapNumber"`
+	Number     uint     `json:"number"`
+	Time       Duration `json:"time"`
+}
+
+// TeamStats mirrors the TeamStats computed by the frontend
+// (frontend/app/helpers/races.ts). Times which are not known yet are
+// omitted from the JSON.
+type TeamStats struct {
+	StartTime           *Time     `json:"startTime,omitempty"`
+	StopTime            *Time     `json:"stopTime,omitempty"`
+	NumLaps             uint      `json:"numLaps"`
+	BestLapTime         *Duration `json:"bestLapTime,omitempty"`
+	BestLapCrossingID   uint      `json:"bestLapCrossingId,omitempty"`
+	CurrentLapStartTime *Time     `json:"currentLapStartTime,omitempty"`
+	// Penalties
+	PenaltyLaps  uint     `json:"penaltyLaps"`
+	PenaltyTime  Duration `json:"penaltyTime"`
+	Disqualified bool     `json:"disqualified"`
+	// Number of laps after deducting penalty laps
+	TotalLaps uint `json:"totalLaps"`
+	// Best lap time with penalty time added
+	AdjustedBestLapTime *Duration `json:"adjustedBestLapTime,omitempty"`
+	// Time from the official start of the race (or from StartTime if
+	// it is not known) to the end of the last counted lap (lap
+	// TotalLaps) without paused time and with penalty time added
+	TotalTime   *Duration         `json:"totalTime,omitempty"`
+	Laps        []LapStats        `json:"laps"`
+	Checkpoints []CheckpointStats `json:"checkpoints"`
+}
+
+// RaceStats contains the official results of a race. For time trials,
+// only TeamA is set and it is computed from crossings with no team
+// assigned.
+type RaceStats struct {
+	RaceID uint       `json:"raceId"`
+	Type   RaceType   `json:"type"`
+	TeamA  TeamStats  `json:"teamA"`
+	TeamB  *TeamStats `json:"teamB,omitempty"`
+}
+
+// computeRaceStats computes race statistics from the race and its
+// crossings. The race must be loaded with the raceDetails scope.
+func computeRaceStats(race *Race) RaceStats {
+	stats := RaceStats{RaceID: race.ID, Type: race.Type}
+	if race.Type == HeadToHead {
+		stats.TeamA = computeTeamStats(race, TeamA)
+		teamB := computeTeamStats(race, TeamB)
+		stats.TeamB = &teamB
+		applyPenalties(race, TeamA, &stats.TeamA)
+		applyPenalties(race, TeamB, stats.TeamB)
+	} else {
+		stats.TeamA = computeTeamStats(race, TeamNotSet)
+		applyPenalties(race, TeamNotSet, &stats.TeamA)
+	}
+	return stats
+}
+
+// sortedCrossings returns the race crossings ordered by time. Crossings
+// with the same time are ordered by their ID.
+func sortedCrossings(race *Race) []Crossing {
+	crossings := make([]Crossing, len(race.Crossings))
+	copy(crossings, race.Crossings)
+	sort.SliceStable(crossings, func(i, j int) bool {
+		ti, tj := time.Time(crossings[i].Time), time.Time(crossings[j].Time)
+		if ti.Equal(tj) {
+			return crossings[i].ID < crossings[j].ID
+		}
+		return ti.Before(tj)
+	})
+	return crossings
+}
+
+// crossingTime returns the time of the race's crossing with the given ID
+func crossingTime(race *Race, id uint) time.Time {
+	for i := range race.Crossings {
+		if race.Crossings[i].ID == id {
+			return time.Time(race.Crossings[i].Time)
+		}
+	}
+	return time.Time{}
+}
+
+// computeTeamStats computes stats of the given team. Laps are measured
+// at the team's lap (home) barrier of the race track. Crossings of
+// other barriers are checkpoints, except for pit barriers. Time when
+// the race was paused is not counted.
+func computeTeamStats(race *Race, team CrossingTeam) TeamStats {
+	track := race.track()
+	lapBarrierId := track.lapBarrier(team)
+	stats := TeamStats{Laps: []LapStats{}, Checkpoints: []CheckpointStats{}}
+	var startTime, stopTime, last *time.Time
+	var checkpointNumber uint
+
+	for _, c := range sortedCrossings(race) {
+		// exclude ignored crossings, crossings during pauses and
+		// crossings of the other team
+		if c.Ignored || c.Paused || c.Team != team {
+			continue
+		}
+		trackBarrier := track.barrier(c.BarrierId)
+		if trackBarrier != nil && trackBarrier.Role == Pit {
+			continue
+		}
+		t := time.Time(c.Time)
+
+		// the first crossing through the lap barrier starts the race
+		if c.BarrierId == lapBarrierId && startTime == nil {
+			startTime = &t
+			// if we know the race duration, we can calculate the stop time
+			if race.Type == TimeTrial && race.TimeDuration != nil && *race.TimeDuration > 0 {
+				stop := extendByPauses(race.Pauses, t, time.Duration(*race.TimeDuration))
+				stopTime = &stop
+			}
+		}
+
+		// ignore crossings after the stop time of fixed-time races
+		if stopTime != nil && t.After(*stopTime) {
+			continue
+		}
+
+		if c.BarrierId == lapBarrierId && last != nil {
+			// two consecutive lap-barrier crossings form a lap
+			stats.NumLaps++
+			checkpointNumber = 0
+			lapTime := t.Sub(*last) - pausedDuration(race.Pauses, *last, t)
+			lap := LapStats{CrossingID: c.ID, Number: stats.NumLaps, Time: Duration(lapTime)}
+			stats.Laps = append(stats.Laps, lap)
+			if stats.BestLapTime == nil || lap.Time < *stats.BestLapTime {
+				stats.BestLapTime = &lap.Time
+				stats.BestLapCrossingID = c.ID
+			}
+		} else if last != nil {
+			// other crossings after a lap-barrier crossing are checkpoints
+			// numbered by the track configuration or by order in the lap
+			checkpointNumber++
+			number := checkpointNumber
+			if trackBarrier != nil && trackBarrier.Role == Checkpoint {
+				number = trackBarrier.Checkpoint
+			}
+			stats.Checkpoints = append(stats.Checkpoints, CheckpointStats{
+				CrossingID: c.ID,
+				LapNumber:  stats.NumLaps + 1,
+				Number:     number,
+				Time:       Duration(t.Sub(*last) - pausedDuration(race.Pauses, *last, t)),
+			})
+		}
+
+		if c.BarrierId == lapBarrierId {
+			last = &t
+		}
+	}
+
+	// If the stop time is not known and the race is already over, the
+	// last lap-barrier crossing is the stop time.
+	if stopTime == nil && last != nil && (race.State == Finished || race.State == Unfinished) {
+		stopTime = last
+	}
+
+	if startTime != nil {
+		ts := Time(*startTime)
+		stats.StartTime = &ts
+	}
+	if stopTime != nil {
+		ts := Time(*stopTime)
+		stats.StopTime = &ts
+	}
+	if last != nil {
+		ts := Time(*last)
+		stats.CurrentLapStartTime = &ts
+	}
+	return stats
+}
+
+func getRaceStats(c echo.Context) error {
+	var race Race
+	if err := c.Bind(&race); err != nil {
+		return err
+	}
+	if err := db.Scopes(raceDetails).First(&race, race.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(
+				http.StatusNotFound,
+				fmt.Sprintf("race with id %d not found", race.ID),
+			)
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, computeRaceStats(&race))
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2022, 6, 28, 10, 0, 0, 0, time.UTC)
+
+// at returns the time d after testStart
+func at(d time.Duration) time.Time {
+	return testStart.Add(d)
+}
+
+// testCrossings returns crossings of the barrier and team at the given
+// times after testStart
+func testCrossings(barrierId uint, team CrossingTeam, times ...time.Duration) []Crossing {
+	crossings := make([]Crossing, len(times))
+	for i, d := range times {
+		crossings[i] = Crossing{Time: Time(at(d)), BarrierId: barrierId, Team: team}
+	}
+	return crossings
+}
+
+// withIds numbers the crossings of the race
+func withIds(crossings ...[]Crossing) []Crossing {
+	var all []Crossing
+	for _, c := range crossings {
+		all = append(all, c...)
+	}
+	for i := range all {
+		all[i].ID = uint(i + 1)
+	}
+	return all
+}
+
+func durationPtr(d time.Duration) *Duration {
+	v := Duration(d)
+	return &v
+}
+
+func TestComputeRaceStats(t *testing.T) {
+	ignored := testCrossings(1, TeamNotSet, 0, 5*time.Second, 10*time.Second)
+	ignored[1].Ignored = true
+	paused := testCrossings(1, TeamNotSet, 0, 5*time.Second, 10*time.Second)
+	paused[1].Paused = true
+	tests := []struct {
+		name string
+		race Race
+		// expected stats of team A and B (if not nil)
+		laps, lapsB uint
+		best, bestB *Duration
+		// 0 if the race is not limited
+		stop            time.Duration
+		currentLapStart time.Duration
+	}{
+		{
+			name: "time trial",
+			race: Race{Type: TimeTrial, Crossings: withIds(testCrossings(1, TeamNotSet, 0, 10*time.Second, 22*time.Second))},
+			laps: 2, best: durationPtr(10 * time.Second), currentLapStart: 22 * time.Second,
+		},
+		{
+			name: "crossings in wrong order",
+			race: Race{Type: TimeTrial, Crossings: withIds(testCrossings(1, TeamNotSet, 22*time.Second, 0, 10*time.Second))},
+			laps: 2, best: durationPtr(10 * time.Second), currentLapStart: 22 * time.Second,
+		},
+		{
+			name: "ignored crossing",
+			race: Race{Type: TimeTrial, Crossings: withIds(ignored)},
+			laps: 1, best: durationPtr(10 * time.Second), currentLapStart: 10 * time.Second,
+		},
+		{
+			name: "crossing during pause",
+			race: Race{Type: TimeTrial, Crossings: withIds(paused)},
+			laps: 1, best: durationPtr(10 * time.Second), currentLapStart: 10 * time.Second,
+		},
+		{
+			name: "pause not counted in lap time",
+			race: Race{
+				Type:      TimeTrial,
+				Crossings: withIds(testCrossings(1, TeamNotSet, 0, 20*time.Second)),
+				Pauses:    []RacePause{testPause(5*time.Second, 10*time.Second)},
+			},
+			laps: 1, best: durationPtr(15 * time.Second), currentLapStart: 20 * time.Second,
+		},
+		{
+			name: "time limit",
+			race: Race{
+				Type:         TimeTrial,
+				TimeDuration: durationPtr(15 * time.Second),
+				Crossings:    withIds(testCrossings(1, TeamNotSet, 0, 10*time.Second, 20*time.Second)),
+			},
+			laps: 1, best: durationPtr(10 * time.Second), currentLapStart: 10 * time.Second,
+			stop: 15 * time.Second,
+		},
+		{
+			name: "time limit extended by pause",
+			race: Race{
+				Type:         TimeTrial,
+				TimeDuration: durationPtr(15 * time.Second),
+				Crossings:    withIds(testCrossings(1, TeamNotSet, 0, 10*time.Second, 20*time.Second)),
+				Pauses:       []RacePause{testPause(2*time.Second, 8*time.Second)},
+			},
+			laps: 2, best: durationPtr(4 * time.Second), currentLapStart: 20 * time.Second,
+			stop: 21 * time.Second,
+		},
+		{
+			name: "finished race stops at the last crossing",
+			race: Race{
+				Type:      TimeTrial,
+				State:     Finished,
+				Crossings: withIds(testCrossings(1, TeamNotSet, 0, 10*time.Second)),
+			},
+			laps: 1, best: durationPtr(10 * time.Second), currentLapStart: 10 * time.Second,
+			stop: 10 * time.Second,
+		},
+		{
+			name: "checkpoints are not laps",
+			race: Race{Type: TimeTrial, Crossings: withIds(
+				testCrossings(1, TeamNotSet, 0, 10*time.Second),
+				testCrossings(2, TeamNotSet, 5*time.Second),
+			)},
+			laps: 1, best: durationPtr(10 * time.Second), currentLapStart: 10 * time.Second,
+		},
+		{
+			name: "head to head",
+			race: Race{Type: HeadToHead, Crossings: withIds(
+				testCrossings(1, TeamA, 0, 10*time.Second),
+				testCrossings(2, TeamB, 0, 12*time.Second, 24*time.Second),
+			)},
+			laps: 1, best: durationPtr(10 * time.Second), currentLapStart: 10 * time.Second,
+			lapsB: 2, bestB: durationPtr(12 * time.Second),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := computeRaceStats(&tt.race)
+			a := stats.TeamA
+			if a.NumLaps != tt.laps || a.TotalLaps != tt.laps {
+				t.Errorf("numLaps = %d, totalLaps = %d, want %d", a.NumLaps, a.TotalLaps, tt.laps)
+			}
+			if !equalDurations(a.BestLapTime, tt.best) {
+				t.Errorf("bestLapTime = %v, want %v", a.BestLapTime, tt.best)
+			}
+			if a.CurrentLapStartTime == nil || !time.Time(*a.CurrentLapStartTime).Equal(at(tt.currentLapStart)) {
+				t.Errorf("currentLapStartTime = %v, want %v", a.CurrentLapStartTime, at(tt.currentLapStart))
+			}
+			switch {
+			case tt.stop == 0 && a.StopTime != nil:
+				t.Errorf("stopTime = %v, want nil", a.StopTime)
+			case tt.stop != 0 && (a.StopTime == nil || !time.Time(*a.StopTime).Equal(at(tt.stop))):
+				t.Errorf("stopTime = %v, want %v", a.StopTime, at(tt.stop))
+			}
+			if tt.race.Type != HeadToHead {
+				if stats.TeamB != nil {
+					t.Errorf("teamB = %v, want nil", stats.TeamB)
+				}
+				return
+			}
+			if stats.TeamB == nil {
+				t.Fatalf("teamB not computed")
+			}
+			if stats.TeamB.NumLaps != tt.lapsB {
+				t.Errorf("teamB numLaps = %d, want %d", stats.TeamB.NumLaps, tt.lapsB)
+			}
+			if !equalDurations(stats.TeamB.BestLapTime, tt.bestB) {
+				t.Errorf("teamB bestLapTime = %v, want %v", stats.TeamB.BestLapTime, tt.bestB)
+			}
+		})
+	}
+}
+
+func TestComputeRaceStatsCheckpoints(t *testing.T) {
+	race := Race{Type: TimeTrial, Crossings: withIds(
+		testCrossings(1, TeamNotSet, 0, 10*time.Second),
+		testCrossings(2, TeamNotSet, 4*time.Second, 13*time.Second),
+	)}
+	stats := computeRaceStats(&race)
+	want := []CheckpointStats{
+		{CrossingID: 3, LapNumber: 1, Number: 1, Time: Duration(4 * time.Second)},
+		{CrossingID: 4, LapNumber: 2, Number: 1, Time: Duration(3 * time.Second)},
+	}
+	if len(stats.TeamA.Checkpoints) != len(want) {
+		t.Fatalf("got %d checkpoints, want %d", len(stats.TeamA.Checkpoints), len(want))
+	}
+	for i, c := range stats.TeamA.Checkpoints {
+		if c != want[i] {
+			t.Errorf("checkpoint %d = %+v, want %+v", i, c, want[i])
+		}
+	}
+}
+
+func equalDurations(a, b *Duration) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func TestApplyPenalties(t *testing.T) {
+	tests := []struct {
+		name      string
+		raceType  RaceType
+		team      CrossingTeam
+		penalties []Penalty
+		// expected values for 3 laps of 10 seconds
+		totalLaps    uint
+		penaltyTime  time.Duration
+		adjustedBest time.Duration
+		totalTime    time.Duration
+		disqualified bool
+	}{
+		{
+			name: "no penalties", raceType: TimeTrial,
+			totalLaps: 3, adjustedBest: 10 * time.Second, totalTime: 30 * time.Second,
+		},
+		{
+			name: "lap deduction and time addition", raceType: TimeTrial,
+			penalties: []Penalty{
+				{Kind: LapDeduction, Laps: 1},
+				{Kind: TimeAddition, Time: Duration(2 * time.Second)},
+				{Kind: TimeAddition, Time: Duration(time.Second)},
+			},
+			totalLaps: 2, penaltyTime: 3 * time.Second, adjustedBest: 13 * time.Second, totalTime: 23 * time.Second,
+		},
+		{
+			name: "more laps deducted than driven", raceType: TimeTrial,
+			penalties: []Penalty{{Kind: LapDeduction, Laps: 5}},
+			totalLaps: 0, adjustedBest: 10 * time.Second,
+		},
+		{
+			name: "disqualification", raceType: TimeTrial,
+			penalties: []Penalty{{Kind: Disqualification}},
+			totalLaps: 3, adjustedBest: 10 * time.Second, totalTime: 30 * time.Second,
+			disqualified: true,
+		},
+		{
+			name: "penalty of the other team", raceType: HeadToHead, team: TeamA,
+			penalties: []Penalty{{Team: TeamB, Kind: LapDeduction, Laps: 1}, {Team: TeamB, Kind: Disqualification}},
+			totalLaps: 3, adjustedBest: 10 * time.Second, totalTime: 30 * time.Second,
+		},
+		{
+			name: "penalty of the team", raceType: HeadToHead, team: TeamB,
+			penalties: []Penalty{{Team: TeamB, Kind: LapDeduction, Laps: 1}, {Team: TeamA, Kind: LapDeduction, Laps: 1}},
+			totalLaps: 2, adjustedBest: 10 * time.Second, totalTime: 20 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			race := Race{
+				Type:      tt.raceType,
+				Penalties: tt.penalties,
+				Crossings: withIds(testCrossings(1, tt.team, 0, 10*time.Second, 20*time.Second, 30*time.Second)),
+			}
+			if tt.team == TeamB {
+				race.Crossings = withIds(testCrossings(2, TeamB, 0, 10*time.Second, 20*time.Second, 30*time.Second))
+			}
+			stats := computeTeamStats(&race, tt.team)
+			applyPenalties(&race, tt.team, &stats)
+			if stats.TotalLaps != tt.totalLaps {
+				t.Errorf("totalLaps = %d, want %d", stats.TotalLaps, tt.totalLaps)
+			}
+			if time.Duration(stats.PenaltyTime) != tt.penaltyTime {
+				t.Errorf("penaltyTime = %v, want %v", time.Duration(stats.PenaltyTime), tt.penaltyTime)
+			}
+			if !equalDurations(stats.AdjustedBestLapTime, durationPtr(tt.adjustedBest)) {
+				t.Errorf("adjustedBestLapTime = %v, want %v", stats.AdjustedBestLapTime, tt.adjustedBest)
+			}
+			var totalTime *Duration
+			if tt.totalTime != 0 {
+				totalTime = durationPtr(tt.totalTime)
+			}
+			if !equalDurations(stats.TotalTime, totalTime) {
+				t.Errorf("totalTime = %v, want %v", stats.TotalTime, totalTime)
+			}
+			if stats.Disqualified != tt.disqualified {
+				t.Errorf("disqualified = %v, want %v", stats.Disqualified, tt.disqualified)
+			}
+		})
+	}
+}
+
+func TestApplyPenaltiesTotalTime(t *testing.T) {
+	startedAt := Time(at(-2 * time.Second))
+	race := Race{
+		Type:      TimeTrial,
+		StartedAt: &startedAt,
+		Crossings: withIds(testCrossings(1, TeamNotSet, 0, 10*time.Second, 20*time.Second)),
+		Pauses:    []RacePause{testPause(12*time.Second, 15*time.Second)},
+		Penalties: []Penalty{{Kind: TimeAddition, Time: Duration(time.Second)}},
+	}
+	stats := computeRaceStats(&race)
+	// measured from the official start, without the pause
+	if want := durationPtr(20 * time.Second); !equalDurations(stats.TeamA.TotalTime, want) {
+		t.Errorf("totalTime = %v, want %v", stats.TeamA.TotalTime, *want)
+	}
+}
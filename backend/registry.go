@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// RegisteredBarrier is a barrier allowed to connect to /barrier/:id.
+// Its ID is the barrier ID used in the URL and in crossings. Only a
+// hash of the barrier key is stored.
+type RegisteredBarrier struct {
+	CommonModelFields
+	Name string `json:"name"`
+	// Where the barrier is installed, e.g. "start/finish line"
+	Location string `json:"location"`
+	// Intended role of the barrier on tracks (informational, roles
+	// used for timing are configured per track)
+	Role BarrierRole `json:"role,omitempty"`
+	// Overrides the default -time-tolerance (see clockfault.go)
+	TimeTolerance *Duration `json:"timeTolerance,omitempty"`
+	KeyHash       string    `json:"-"`
+	Disabled      bool      `json:"disabled"`
+	Connected     bool      `gorm:"-" json:"connected"`
+}
+
+// RegisteredBarrierResponse includes the barrier key, which is returned
+// only when the barrier is registered or its key is rotated.
+type RegisteredBarrierResponse struct {
+	RegisteredBarrier
+	Key string `json:"key"`
+}
+
+// barrierRegistryEnabled returns true once a barrier is registered.
+// Until then any barrier can connect in open mode (see openMode), as
+// before the registry was introduced.
+func barrierRegistryEnabled() (bool, error) {
+	var cnt int64
+	err := db.Model(&RegisteredBarrier{}).Count(&cnt).Error
+	return cnt > 0, err
+}
+
+// authorizeBarrier checks the key sent by the barrier in the
+// Authorization header
+func authorizeBarrier(c echo.Context, id uint) error {
+	var barrier RegisteredBarrier
+	if err := db.Limit(1).Find(&barrier, id).Error; err != nil {
+		return err
+	}
+	if barrier.ID == 0 {
+		if enabled, err := barrierRegistryEnabled(); err != nil {
+			return err
+		} else if !enabled && openMode() {
+			return nil
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("barrier %d not registered", id))
+	}
+	if barrier.Disabled {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("barrier %d is disabled", id))
+	}
+	key := c.Request().Header.Get(echo.HeaderAuthorization)
+	if bcrypt.CompareHashAndPassword([]byte(barrier.KeyHash), []byte(key)) != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid key")
+	}
+	return nil
+}
+
+// setKey sets the barrier key to key or, if empty, to a random key. It
+// returns the key.
+func (b *RegisteredBarrier) setKey(key string) (string, error) {
+	if key == "" {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		key = hex.EncodeToString(buf)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	b.KeyHash = string(hash)
+	return key, nil
+}
+
+func (b *RegisteredBarrier) validate() error {
+	if b.ID == 0 {
+		return fmt.Errorf("id not specified")
+	}
+	switch b.Role {
+	case "", LapLine, Checkpoint, Pit:
+	default:
+		return fmt.Errorf("unsupported role '%s'", string(b.Role))
+	}
+	if b.TimeTolerance != nil && *b.TimeTolerance <= 0 {
+		return fmt.Errorf("timeTolerance must be positive")
+	}
+	return nil
+}
+
+// importBarrierKeys registers barriers with keys from the -keys file
+// ("/barrier/<id>" entries), which were used before the registry was
+// introduced. Already registered barriers are left unchanged.
+func importBarrierKeys(keys map[string]string) {
+	for path, key := range keys {
+		if !strings.HasPrefix(path, "/barrier/") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(path, "/barrier/"), 10, 32)
+		if err != nil {
+			log.Printf("invalid barrier key path %s", path)
+			continue
+		}
+		var barrier RegisteredBarrier
+		if err := db.Limit(1).Find(&barrier, id).Error; err != nil {
+			log.Fatalf("barrier key import: %v", err)
+		}
+		if barrier.ID != 0 {
+			continue
+		}
+		barrier = RegisteredBarrier{CommonModelFields: CommonModelFields{ID: uint(id)}, Name: fmt.Sprintf("Barrier %d", id)}
+		if _, err := barrier.setKey(key); err != nil {
+			log.Fatalf("barrier key import: %v", err)
+		}
+		if err := db.Create(&barrier).Error; err != nil {
+			log.Fatalf("barrier key import: %v", err)
+		}
+		log.Printf("registered barrier %d with key from the keys file", id)
+	}
+}
+
+func findRegisteredBarrier(id uint, barrier *RegisteredBarrier) error {
+	if err := db.First(barrier, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(
+				http.StatusNotFound,
+				fmt.Sprintf("barrier with id %d not registered", id),
+			)
+		}
+		return err
+	}
+	return nil
+}
+
+func getRegisteredBarriers(c echo.Context) error {
+	var barriers []RegisteredBarrier
+	if err := db.Order("id").Find(&barriers).Error; err != nil {
+		return err
+	}
+	reply := make(chan []BarrierHealth)
+	hub.barrierHealthRequest <- reply
+	connected := make(map[uint]bool)
+	for _, health := range <-reply {
+		connected[health.BarrierId] = health.Connected
+	}
+	for i := range barriers {
+		barriers[i].Connected = connected[barriers[i].ID]
+	}
+	return c.JSON(http.StatusOK, barriers)
+}
+
+// registerBarrier adds the barrier to the registry. If the request
+// contains no key, a random key is generated. The key is returned only
+// in this response.
+func registerBarrier(c echo.Context) error {
+	var req struct {
+		RegisteredBarrier
+		Key string `json:"key"`
+	}
+	if err := (&echo.DefaultBinder{}).BindBody(c, &req); err != nil {
+		return err
+	}
+	barrier := req.RegisteredBarrier
+	if err := barrier.validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	var cnt int64
+	if err := db.Unscoped().Model(&RegisteredBarrier{}).Where("id = ?", barrier.ID).Count(&cnt).Error; err != nil {
+		return err
+	}
+	if cnt > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("barrier %d already registered", barrier.ID))
+	}
+	key, err := barrier.setKey(req.Key)
+	if err != nil {
+		return err
+	}
+	if err := db.Create(&barrier).Error; err != nil {
+		return err
+	}
+	audit(c, "barrier", barrier.ID, 0, nil, barrier)
+	return c.JSON(http.StatusOK, RegisteredBarrierResponse{barrier, key})
+}
+
+// updateRegisteredBarrier updates the name, location, role, time
+// tolerance and the disabled flag of the barrier. Disabled barriers are disconnected.
+func updateRegisteredBarrier(c echo.Context) error {
+	var req RegisteredBarrier
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	var barrier RegisteredBarrier
+	if err := findRegisteredBarrier(req.ID, &barrier); err != nil {
+		return err
+	}
+	if err := req.validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	before := barrier
+	// select all fields otherwise GoORM will ignore zero fields
+	if err := db.Model(&barrier).Select("Name", "Location", "Role", "TimeTolerance", "Disabled").Updates(&req).Error; err != nil {
+		return err
+	}
+	if barrier.Disabled {
+		hub.disconnectBarrier <- barrier.ID
+	}
+	audit(c, "barrier", barrier.ID, 0, before, barrier)
+	return c.JSON(http.StatusOK, barrier)
+}
+
+// rotateBarrierKey sets a new key of the barrier (the one from the
+// request or a random one) and disconnects the barrier if it is
+// connected with the old key.
+func rotateBarrierKey(c echo.Context) error {
+	var req struct {
+		ID  uint   `param:"id"`
+		Key string `json:"key"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	var barrier RegisteredBarrier
+	if err := findRegisteredBarrier(req.ID, &barrier); err != nil {
+		return err
+	}
+	key, err := barrier.setKey(req.Key)
+	if err != nil {
+		return err
+	}
+	if err := db.Model(&barrier).Update("KeyHash", barrier.KeyHash).Error; err != nil {
+		return err
+	}
+	hub.disconnectBarrier <- barrier.ID
+	// the key itself is not recorded
+	audit(c, "barrier", barrier.ID, 0, nil, nil)
+	return c.JSON(http.StatusOK, RegisteredBarrierResponse{barrier, key})
+}
+
+// disconnectBarrier closes the websocket of the barrier. The barrier
+// can connect again unless it is disabled.
+func disconnectBarrier(c echo.Context) error {
+	var id uint
+	if err := echo.PathParamsBinder(c).MustUint("id", &id).BindError(); err != nil {
+		return err
+	}
+	hub.disconnectBarrier <- id
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// testBarrier registers the barrier with the key
+func testBarrier(t *testing.T, id uint, key string, disabled bool) {
+	t.Helper()
+	barrier := RegisteredBarrier{CommonModelFields: CommonModelFields{ID: id}, Disabled: disabled}
+	if _, err := barrier.setKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&barrier).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// authorizeStatus returns the HTTP status of authorizeBarrier for the
+// barrier connecting with the key
+func authorizeStatus(t *testing.T, id uint, key string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/barrier/1", nil)
+	if key != "" {
+		req.Header.Set(echo.HeaderAuthorization, key)
+	}
+	err := authorizeBarrier(echo.New().NewContext(req, httptest.NewRecorder()), id)
+	var httpErr *echo.HTTPError
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.As(err, &httpErr):
+		return httpErr.Code
+	}
+	t.Fatal(err)
+	return 0
+}
+
+func TestAuthorizeBarrier(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T)
+		id    uint
+		key   string
+		want  int
+	}{
+		{"open mode", func(t *testing.T) {}, 1, "", http.StatusOK},
+		{"keys file", func(t *testing.T) {
+			keys = map[string]string{"POST": "post-key"}
+		}, 1, "", http.StatusUnauthorized},
+		{"user accounts", func(t *testing.T) {
+			testSession(t, Admin, testStart)
+		}, 1, "", http.StatusUnauthorized},
+		{"not registered", func(t *testing.T) {
+			testBarrier(t, 2, "key2", false)
+		}, 1, "key2", http.StatusUnauthorized},
+		{"registered", func(t *testing.T) {
+			testBarrier(t, 1, "key1", false)
+		}, 1, "key1", http.StatusOK},
+		{"invalid key", func(t *testing.T) {
+			testBarrier(t, 1, "key1", false)
+		}, 1, "key2", http.StatusUnauthorized},
+		{"no key", func(t *testing.T) {
+			testBarrier(t, 1, "key1", false)
+		}, 1, "", http.StatusUnauthorized},
+		{"disabled", func(t *testing.T) {
+			testBarrier(t, 1, "key1", true)
+		}, 1, "key1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDb(t)
+			tt.setup(t)
+			if got := authorizeStatus(t, tt.id, tt.key); got != tt.want {
+				t.Errorf("authorizeBarrier() status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+type StandingStatus string
+
+const (
+	// The team has at least one finished race and is ranked.
+	Ranked StandingStatus = "ranked"
+	// The team was disqualified from all its finished races.
+	Disqualified StandingStatus = "dsq"
+	// The team has only unfinished races (did not finish).
+	DidNotFinish StandingStatus = "dnf"
+)
+
+// statusOrder defines ranking of teams with different status
+var statusOrder = map[StandingStatus]int{Ranked: 0, Disqualified: 1, DidNotFinish: 2}
+
+// Standing is one row of the results table.
+type Standing struct {
+	// Rank is shared by tied teams (e.g. 1, 2, 2, 4). Disqualified
+	// teams and teams which did not finish are ranked after all other
+	// teams.
+	Rank   uint           `json:"rank"`
+	Tied   bool           `json:"tied"`
+	Status StandingStatus `json:"status"`
+	Team   Team           `json:"team"`
+	// Number of finished races counted in the standing
+	Races uint `json:"races"`
+	// Number of unfinished races
+	Unfinished uint `json:"unfinished"`
+
+	// Number of races the team was disqualified from
+	DisqualifiedRaces uint `json:"disqualifiedRaces"`
+
+	// Time trial: the best result of the team (most laps, then best
+	// lap). Penalties are already applied.
+	NumLaps     uint      `json:"numLaps"`
+	BestLapTime *Duration `json:"bestLapTime,omitempty"`
+	BestRaceID  uint      `json:"bestRaceId,omitempty"`
+
+	// Head-to-head: outcomes of the team's races
+	Wins   uint `json:"wins"`
+	Draws  uint `json:"draws"`
+	Losses uint `json:"losses"`
+}
+
+type Standings struct {
+	Type      RaceType   `json:"type"`
+	Round     *uint32    `json:"round,omitempty"`
+	Standings []Standing `json:"standings"`
+}
+
+// headToHeadWinner returns the winner of a head-to-head race. A
+// disqualified team loses. Otherwise, the team with more laps (after
+// penalties) wins. When both teams have the same number of laps, the
+// team that completed them first (with penalty time added) wins.
+// TeamNotSet means a draw or that both teams were disqualified.
+func headToHeadWinner(stats *RaceStats) CrossingTeam {
+	a, b := stats.TeamA, stats.TeamB
+	if b == nil || (a.Disqualified && b.Disqualified) {
+		return TeamNotSet
+	}
+	if a.Disqualified != b.Disqualified {
+		if b.Disqualified {
+			return TeamA
+		}
+		return TeamB
+	}
+	if a.TotalLaps != b.TotalLaps {
+		if a.TotalLaps > b.TotalLaps {
+			return TeamA
+		}
+		return TeamB
+	}
+	// Total times are measured from the same start and a team with
+	// deducted laps may be on a later lap than the time of its last
+	// counted lap.
+	if a.TotalLaps == 0 || a.TotalTime == nil || b.TotalTime == nil {
+		return TeamNotSet
+	}
+	switch {
+	case *a.TotalTime < *b.TotalTime:
+		return TeamA
+	case *b.TotalTime < *a.TotalTime:
+		return TeamB
+	}
+	return TeamNotSet
+}
+
+// betterTimeTrial reports whether the result with laps and bestLap is
+// better than the standing s.
+func betterTimeTrial(laps uint, bestLap *Duration, s *Standing) bool {
+	if laps != s.NumLaps {
+		return laps > s.NumLaps
+	}
+	if bestLap == nil {
+		return false
+	}
+	return s.BestLapTime == nil || *bestLap < *s.BestLapTime
+}
+
+// compareStandings returns a negative number when a ranks before b,
+// a positive number when b ranks before a and zero for a tie.
+func compareStandings(raceType RaceType, a, b *Standing) int {
+	if a.Status != b.Status {
+		return statusOrder[a.Status] - statusOrder[b.Status]
+	}
+	if a.Status != Ranked {
+		return 0
+	}
+	if raceType == HeadToHead {
+		if a.Wins != b.Wins {
+			return int(b.Wins) - int(a.Wins)
+		}
+		if a.Draws != b.Draws {
+			return int(b.Draws) - int(a.Draws)
+		}
+		return int(b.NumLaps) - int(a.NumLaps)
+	}
+	if a.NumLaps != b.NumLaps {
+		return int(b.NumLaps) - int(a.NumLaps)
+	}
+	switch {
+	case a.BestLapTime == nil && b.BestLapTime == nil:
+		return 0
+	case a.BestLapTime == nil:
+		return 1
+	case b.BestLapTime == nil:
+		return -1
+	case *a.BestLapTime < *b.BestLapTime:
+		return -1
+	case *a.BestLapTime > *b.BestLapTime:
+		return 1
+	}
+	return 0
+}
+
+// computeStandings ranks teams based on finished races. Unfinished
+// races only make the team appear in the standings as DNF when it has
+// no finished race. Penalties are applied to race results; results of
+// races the team was disqualified from are not counted.
+func computeStandings(raceType RaceType, races []Race) []Standing {
+	byTeam := make(map[uint]*Standing)
+	order := make([]uint, 0)
+	standingOf := func(team Team) *Standing {
+		s, ok := byTeam[team.ID]
+		if !ok {
+			s = &Standing{Team: team, Status: DidNotFinish}
+			byTeam[team.ID] = s
+			order = append(order, team.ID)
+		}
+		return s
+	}
+
+	for i := range races {
+		race := &races[i]
+		teams := []*Standing{standingOf(race.TeamA)}
+		if race.Type == HeadToHead && race.TeamB != nil {
+			teams = append(teams, standingOf(*race.TeamB))
+		}
+		if race.State == Unfinished {
+			for _, s := range teams {
+				s.Unfinished++
+			}
+			continue
+		}
+		stats := computeRaceStats(race)
+		teamStats := []*TeamStats{&stats.TeamA, stats.TeamB}
+		for i, s := range teams {
+			s.Races++
+			if teamStats[i].Disqualified {
+				s.DisqualifiedRaces++
+				if s.Status == DidNotFinish {
+					s.Status = Disqualified
+				}
+			} else {
+				s.Status = Ranked
+			}
+		}
+		if raceType == HeadToHead {
+			if len(teams) < 2 {
+				continue
+			}
+			a, b := teams[0], teams[1]
+			if !stats.TeamA.Disqualified {
+				a.NumLaps += stats.TeamA.TotalLaps
+			}
+			if !stats.TeamB.Disqualified {
+				b.NumLaps += stats.TeamB.TotalLaps
+			}
+			switch headToHeadWinner(&stats) {
+			case TeamA:
+				a.Wins++
+				b.Losses++
+			case TeamB:
+				b.Wins++
+				a.Losses++
+			default:
+				if stats.TeamA.Disqualified {
+					a.Losses++
+					b.Losses++
+				} else {
+					a.Draws++
+					b.Draws++
+				}
+			}
+			continue
+		}
+		s := teams[0]
+		if stats.TeamA.Disqualified {
+			continue
+		}
+		if s.BestRaceID == 0 || betterTimeTrial(stats.TeamA.TotalLaps, stats.TeamA.AdjustedBestLapTime, s) {
+			s.NumLaps = stats.TeamA.TotalLaps
+			s.BestLapTime = stats.TeamA.AdjustedBestLapTime
+			s.BestRaceID = race.ID
+		}
+	}
+
+	standings := make([]Standing, 0, len(order))
+	for _, id := range order {
+		standings = append(standings, *byTeam[id])
+	}
+	sort.SliceStable(standings, func(i, j int) bool {
+		return compareStandings(raceType, &standings[i], &standings[j]) < 0
+	})
+	for i := range standings {
+		if i > 0 && compareStandings(raceType, &standings[i-1], &standings[i]) == 0 {
+			standings[i].Rank = standings[i-1].Rank
+			// teams which did not finish are not considered tied
+			standings[i].Tied = standings[i].Status == Ranked
+			standings[i-1].Tied = standings[i].Tied
+		} else {
+			standings[i].Rank = uint(i + 1)
+		}
+	}
+	return standings
+}
+
+func getStandings(c echo.Context) error {
+	var result Standings
+	var round uint32
+	if err := echo.QueryParamsBinder(c).
+		String("type", (*string)(&result.Type)).
+		Uint32("round", &round).
+		BindError(); err != nil {
+		return err
+	}
+	if result.Type != TimeTrial && result.Type != HeadToHead {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			"type must be either time_trial or head_to_head",
+		)
+	}
+	scope, err := eventScope(c)
+	if err != nil {
+		return err
+	}
+	query := db.Scopes(scope).Where("type = ? AND state IN ?", result.Type, []RaceState{Finished, Unfinished})
+	if c.QueryParam("round") != "" {
+		result.Round = &round
+		query = query.Where("round = ?", round)
+	}
+	var races []Race
+	if err := query.Scopes(raceDetails).Preload("TeamA").Preload("TeamB").Find(&races).Error; err != nil {
+		return err
+	}
+	result.Standings = computeStandings(result.Type, races)
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testTeam(id uint) Team {
+	return Team{CommonModelFields: CommonModelFields{ID: id}}
+}
+
+// testTimeTrial returns a finished time trial of the team with laps of
+// the given times
+func testTimeTrial(id uint, team Team, laps ...time.Duration) Race {
+	times := []time.Duration{0}
+	for _, lap := range laps {
+		times = append(times, times[len(times)-1]+lap)
+	}
+	return Race{
+		CommonModelFields: CommonModelFields{ID: id},
+		Type:              TimeTrial,
+		State:             Finished,
+		TeamA:             team,
+		Crossings:         withIds(testCrossings(1, TeamNotSet, times...)),
+	}
+}
+
+// testHeadToHead returns a finished head-to-head race in which the
+// teams crossed their lap barriers at the given times
+func testHeadToHead(id uint, teamA, teamB Team, timesA, timesB []time.Duration) Race {
+	return Race{
+		CommonModelFields: CommonModelFields{ID: id},
+		Type:              HeadToHead,
+		State:             Finished,
+		TeamA:             teamA,
+		TeamB:             &teamB,
+		Crossings:         withIds(testCrossings(1, TeamA, timesA...), testCrossings(2, TeamB, timesB...)),
+	}
+}
+
+func TestHeadToHeadWinner(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b TeamStats
+		want CrossingTeam
+	}{
+		{"more laps", TeamStats{TotalLaps: 3}, TeamStats{TotalLaps: 2}, TeamA},
+		{"fewer laps", TeamStats{TotalLaps: 1}, TeamStats{TotalLaps: 2}, TeamB},
+		{"disqualified", TeamStats{TotalLaps: 3, Disqualified: true}, TeamStats{TotalLaps: 1}, TeamB},
+		{"both disqualified", TeamStats{Disqualified: true}, TeamStats{Disqualified: true}, TeamNotSet},
+		{"same laps, earlier", TeamStats{TotalLaps: 2, TotalTime: durationPtr(20 * time.Second)},
+			TeamStats{TotalLaps: 2, TotalTime: durationPtr(21 * time.Second)}, TeamA},
+		{"same laps, later", TeamStats{TotalLaps: 2, TotalTime: durationPtr(22 * time.Second)},
+			TeamStats{TotalLaps: 2, TotalTime: durationPtr(21 * time.Second)}, TeamB},
+		{"same laps, same time", TeamStats{TotalLaps: 2, TotalTime: durationPtr(20 * time.Second)},
+			TeamStats{TotalLaps: 2, TotalTime: durationPtr(20 * time.Second)}, TeamNotSet},
+		{"no laps", TeamStats{}, TeamStats{}, TeamNotSet},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			if got := headToHeadWinner(&RaceStats{TeamA: tt.a, TeamB: &b}); got != tt.want {
+				t.Errorf("headToHeadWinner() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeadToHeadWinnerLapDeduction(t *testing.T) {
+	// team A drives 3 laps and team B 2 laps, but team A has a lap
+	// deducted and completed its second lap after team B
+	race := testHeadToHead(1, testTeam(1), testTeam(2),
+		[]time.Duration{0, 10 * time.Second, 22 * time.Second, 30 * time.Second},
+		[]time.Duration{0, 10 * time.Second, 21 * time.Second})
+	race.Penalties = []Penalty{{Team: TeamA, Kind: LapDeduction, Laps: 1}}
+	stats := computeRaceStats(&race)
+	if got := headToHeadWinner(&stats); got != TeamB {
+		t.Errorf("headToHeadWinner() = %d, want %d", got, TeamB)
+	}
+}
+
+func TestComputeStandings(t *testing.T) {
+	disqualified := testTimeTrial(5, testTeam(4), 8*time.Second, 8*time.Second, 8*time.Second)
+	disqualified.Penalties = []Penalty{{Kind: Disqualification}}
+	unfinished := testTimeTrial(6, testTeam(5), 8*time.Second)
+	unfinished.State = Unfinished
+	penalized := testTimeTrial(8, testTeam(7), 9*time.Second, 9*time.Second)
+	penalized.Penalties = []Penalty{{Kind: TimeAddition, Time: Duration(2 * time.Second)}}
+
+	type rank struct {
+		team   uint
+		rank   uint
+		tied   bool
+		status StandingStatus
+	}
+	tests := []struct {
+		name     string
+		raceType RaceType
+		races    []Race
+		want     []rank
+	}{
+		{
+			name:     "time trial",
+			raceType: TimeTrial,
+			races: []Race{
+				testTimeTrial(1, testTeam(1), 10*time.Second, 11*time.Second),
+				testTimeTrial(2, testTeam(2), 12*time.Second, 10*time.Second),
+				testTimeTrial(3, testTeam(3), 12*time.Second, 12*time.Second, 12*time.Second),
+				// the better result of the team counts
+				testTimeTrial(4, testTeam(1), 13*time.Second),
+				disqualified,
+				unfinished,
+				testTimeTrial(7, testTeam(6), 9*time.Second),
+				// 9 s + 2 s penalty
+				penalized,
+			},
+			want: []rank{
+				{3, 1, false, Ranked},
+				{1, 2, true, Ranked},
+				{2, 2, true, Ranked},
+				{7, 4, false, Ranked},
+				{6, 5, false, Ranked},
+				{4, 6, false, Disqualified},
+				{5, 7, false, DidNotFinish},
+			},
+		},
+		{
+			name:     "head to head",
+			raceType: HeadToHead,
+			races: []Race{
+				// team 1 beats team 2 (2 laps to 1)
+				testHeadToHead(1, testTeam(1), testTeam(2),
+					[]time.Duration{0, 10 * time.Second, 20 * time.Second}, []time.Duration{0, 15 * time.Second}),
+				// team 3 and team 4 draw
+				testHeadToHead(2, testTeam(3), testTeam(4),
+					[]time.Duration{0, 10 * time.Second}, []time.Duration{0, 10 * time.Second}),
+				// team 2 beats team 3 by finishing the lap first
+				testHeadToHead(3, testTeam(2), testTeam(3),
+					[]time.Duration{0, 10 * time.Second}, []time.Duration{0, 11 * time.Second}),
+			},
+			want: []rank{
+				{1, 1, true, Ranked},
+				{2, 1, true, Ranked},
+				// same draws, more laps
+				{3, 3, false, Ranked},
+				{4, 4, false, Ranked},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			standings := computeStandings(tt.raceType, tt.races)
+			if len(standings) != len(tt.want) {
+				t.Fatalf("got %d standings, want %d", len(standings), len(tt.want))
+			}
+			for i, want := range tt.want {
+				s := standings[i]
+				got := rank{s.Team.ID, s.Rank, s.Tied, s.Status}
+				if got != want {
+					t.Errorf("standing %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// How often the supervisor checks the limits of the current races.
+// Races are finished at most this late, their stats are not affected.
+const supervisorPeriod = time.Second
+
+// limitReached checks whether the race reached its time or lap limit.
+// race must be loaded with the raceDetails scope. Penalties do not
+// affect the limits.
+func limitReached(race *Race, now time.Time) (FinishReason, bool) {
+	stats := computeRaceStats(race)
+	switch race.Type {
+	case TimeTrial:
+		// The time limit is counted from the first crossing of the
+		// lap barrier (see computeTeamStats) or, if the car has not
+		// crossed it yet, from the start of the race.
+		stopTime := stats.TeamA.StopTime
+		if stopTime == nil && race.StartedAt != nil && race.TimeDuration != nil && *race.TimeDuration > 0 {
+			stop := Time(extendByPauses(race.Pauses, time.Time(*race.StartedAt), time.Duration(*race.TimeDuration)))
+			stopTime = &stop
+		}
+		if stopTime != nil && now.After(time.Time(*stopTime)) {
+			return FinishedByTimeLimit, true
+		}
+	case HeadToHead:
+		if race.LapsDuration == nil || *race.LapsDuration == 0 {
+			break
+		}
+		laps := *race.LapsDuration
+		if stats.TeamA.NumLaps >= laps || (stats.TeamB != nil && stats.TeamB.NumLaps >= laps) {
+			return FinishedByLapLimit, true
+		}
+	}
+	return "", false
+}
+
+func superviseRace(raceId uint) {
+	var race Race
+	if err := db.Scopes(raceDetails).First(&race, raceId).Error; err != nil {
+		log.Printf("supervisor: error loading race %d: %v", raceId, err)
+		return
+	}
+	if race.State != Running {
+		return
+	}
+	reason, ok := limitReached(&race, time.Now())
+	if !ok {
+		return
+	}
+	log.Printf("supervisor: finishing race %d (%s)", race.ID, reason)
+	entry := &AuditEntry{Actor: "supervisor", Action: "finish (" + string(reason) + ")"}
+	if _, err := changeRaceState(race.ID, []RaceState{Running}, Finished, reason, entry); err != nil {
+		log.Printf("supervisor: error finishing race %d: %v", race.ID, err)
+	}
+}
+
+// raceSupervisor finishes current races when their time or lap limit
+// is reached, so that operators do not need to stop them manually.
+func raceSupervisor() {
+	ticker := time.NewTicker(supervisorPeriod)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+
+		for _, raceId := range currentRaces.ids() {
+			superviseRace(raceId)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// BarrierTelemetry is the health status periodically reported by the
+// barrier in {"status":{...}} messages.
+type BarrierTelemetry struct {
+	// Firmware version (git describe)
+	FirmwareVersion string `json:"firmwareVersion"`
+	// Seconds since the barrier started
+	Uptime uint64 `json:"uptime"`
+	// State of the optical sensor, e.g. "clear" or "blocked"
+	Sensor string `json:"sensor"`
+	// CPU temperature in °C
+	CpuTemperature *float64 `json:"cpuTemperature,omitempty"`
+	// Wi-Fi signal level in dBm
+	WifiSignal *int `json:"wifiSignal,omitempty"`
+}
+
+// BarrierHealth is the latest known state of a barrier. Values are
+// kept after the barrier disconnects.
+type BarrierHealth struct {
+	BarrierId   uint  `json:"barrierId"`
+	Connected   bool  `json:"connected"`
+	ConnectedAt *Time `json:"connectedAt,omitempty"`
+	// How many times a new connection replaced an existing one
+	Takeovers uint `json:"takeovers"`
+	// How many new connections were rejected, because the existing
+	// one still answered pings
+	RejectedTakeovers uint `json:"rejectedTakeovers"`
+	// Round-trip time of the last websocket ping
+	Rtt *Duration `json:"rtt,omitempty"`
+	// Last change of the clock fault state (see clockfault.go)
+	ClockFault *BarrierClockFault `json:"clockFault,omitempty"`
+	// Last status reported by the barrier and when it was received
+	Telemetry     *BarrierTelemetry `json:"telemetry,omitempty"`
+	TelemetryTime *Time             `json:"telemetryTime,omitempty"`
+}
+
+// BarrierTakeover is sent to operators when a new connection of the
+// barrier replaces an existing one, which was probably stale.
+type BarrierTakeover struct {
+	BarrierId uint `json:"barrierId"`
+	Time      Time `json:"time"`
+	// When the replaced connection was established
+	PreviousConnectedAt *Time `json:"previousConnectedAt,omitempty"`
+	// The new connection was rejected, because the existing one still
+	// answers pings. Two devices probably use the same barrier ID.
+	Rejected bool `json:"rejected,omitempty"`
+}
+
+// BarrierHealthUpdate carries new values measured or reported for the
+// barrier. Nil fields are left unchanged.
+type BarrierHealthUpdate struct {
+	BarrierId  uint
+	Rtt        *Duration
+	Telemetry  *BarrierTelemetry
+	ClockFault *BarrierClockFault
+}
+
+// updateHealth stores the update in the hub. It must be called from
+// the hub goroutine.
+func (h *Hub) updateHealth(u BarrierHealthUpdate) {
+	health := h.health(u.BarrierId)
+	if u.Rtt != nil {
+		health.Rtt = u.Rtt
+	}
+	if u.ClockFault != nil {
+		health.ClockFault = u.ClockFault
+	}
+	if u.Telemetry != nil {
+		now := Time(time.Now())
+		health.Telemetry = u.Telemetry
+		health.TelemetryTime = &now
+	}
+}
+
+// health returns the health record of the barrier, creating it if
+// needed. It must be called from the hub goroutine.
+func (h *Hub) health(barrierId uint) *BarrierHealth {
+	health, ok := h.barrierHealth[barrierId]
+	if !ok {
+		health = &BarrierHealth{BarrierId: barrierId}
+		h.barrierHealth[barrierId] = health
+	}
+	return health
+}
+
+// healthSnapshot returns copies of all health records ordered by
+// barrier ID. It must be called from the hub goroutine.
+func (h *Hub) healthSnapshot() []BarrierHealth {
+	list := make([]BarrierHealth, 0, len(h.barrierHealth))
+	for _, health := range h.barrierHealth {
+		list = append(list, *health)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].BarrierId < list[j].BarrierId })
+	return list
+}
+
+func getBarriers(c echo.Context) error {
+	reply := make(chan []BarrierHealth)
+	hub.barrierHealthRequest <- reply
+	return c.JSON(http.StatusOK, <-reply)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+type BarrierRole string
+
+const (
+	LapLine    BarrierRole = "lap_line"
+	Checkpoint BarrierRole = "checkpoint"
+	Pit        BarrierRole = "pit"
+)
+
+// SQL interface
+
+func (e *BarrierRole) Scan(value interface{}) error {
+	*e = BarrierRole(value.(string))
+	return nil
+}
+
+func (e BarrierRole) Value() (driver.Value, error) {
+	return string(e), nil
+}
+
+// TrackBarrier assigns a role to a barrier on a track.
+type TrackBarrier struct {
+	ID        uint        `gorm:"primaryKey" json:"-"`
+	TrackID   uint        `gorm:"uniqueIndex:idx_track_barrier" json:"-"`
+	BarrierId uint        `gorm:"uniqueIndex:idx_track_barrier" json:"barrierId"`
+	Role      BarrierRole `json:"role"`
+	// Checkpoint number (1, 2, …) if Role == Checkpoint
+	Checkpoint uint `json:"checkpoint,omitempty"`
+	// Main barrier of the group if this barrier is a redundant sensor
+	// of it (see fusion.go)
+	Group uint `json:"group,omitempty"`
+}
+
+// Track describes the barriers placed on a track and their roles.
+type Track struct {
+	CommonModelFields
+	Name     string         `gorm:"uniqueIndex" json:"name"`
+	Barriers []TrackBarrier `json:"barriers"`
+	// Lap (home) barrier of team A. It is also used for time trials.
+	TeamALapBarrier uint `json:"teamALapBarrier"`
+	// Lap (home) barrier of team B (head-to-head only)
+	TeamBLapBarrier uint `json:"teamBLapBarrier"`
+	// Crossings of a barrier closer than DebounceTime to the previous
+	// one are ignored (default 1s, 0 disables the filter)
+	DebounceTime *Duration `json:"debounceTime,omitempty"`
+	// Laps shorter than MinLapTime are not counted (nil or 0
+	// disables the filter)
+	MinLapTime *Duration `json:"minLapTime,omitempty"`
+	// Detections of grouped barriers closer than FusionWindow are
+	// merged into one crossing (default 100ms)
+	FusionWindow *Duration `json:"fusionWindow,omitempty"`
+}
+
+// defaultTrack is used for races without a track. It corresponds to
+// the original hard-coded setup with barrier 1 being the lap line of
+// time trials and team A, and barrier 2 the lap line of team B.
+var defaultTrack = Track{
+	Name: "default",
+	Barriers: []TrackBarrier{
+		{BarrierId: 1, Role: LapLine},
+		{BarrierId: 2, Role: LapLine},
+	},
+	TeamALapBarrier: 1,
+	TeamBLapBarrier: 2,
+}
+
+// lapBarrier returns the lap barrier of the given team slot. Crossings
+// without team (time trials) use the lap barrier of team A.
+func (t *Track) lapBarrier(team CrossingTeam) uint {
+	if team == TeamB {
+		return t.TeamBLapBarrier
+	}
+	return t.TeamALapBarrier
+}
+
+// lapBarrierTeam returns the team slot whose lap barrier is barrierId
+// or TeamNotSet if the barrier is not a lap barrier of any team.
+func (t *Track) lapBarrierTeam(barrierId uint) CrossingTeam {
+	switch barrierId {
+	case t.TeamALapBarrier:
+		return TeamA
+	case t.TeamBLapBarrier:
+		return TeamB
+	}
+	return TeamNotSet
+}
+
+// barrier returns the configuration of the barrier or nil if the
+// barrier is not placed on the track.
+func (t *Track) barrier(barrierId uint) *TrackBarrier {
+	for i := range t.Barriers {
+		if t.Barriers[i].BarrierId == barrierId {
+			return &t.Barriers[i]
+		}
+	}
+	return nil
+}
+
+func (t *Track) validate() error {
+	seen := make(map[uint]bool)
+	for _, b := range t.Barriers {
+		if seen[b.BarrierId] {
+			return fmt.Errorf("barrier %d specified more than once", b.BarrierId)
+		}
+		seen[b.BarrierId] = true
+		switch b.Role {
+		case LapLine, Pit:
+		case Checkpoint:
+			if b.Checkpoint == 0 {
+				return fmt.Errorf("checkpoint number of barrier %d not specified", b.BarrierId)
+			}
+		default:
+			return fmt.Errorf("unsupported role '%s' of barrier %d", string(b.Role), b.BarrierId)
+		}
+	}
+	for _, id := range []uint{t.TeamALapBarrier, t.TeamBLapBarrier} {
+		if id == 0 {
+			continue
+		}
+		if b := t.barrier(id); b == nil || b.Role != LapLine {
+			return fmt.Errorf("lap barrier %d is not a lap_line barrier of the track", id)
+		}
+	}
+	if t.TeamALapBarrier == 0 {
+		return fmt.Errorf("teamALapBarrier not specified")
+	}
+	if t.TeamALapBarrier == t.TeamBLapBarrier {
+		return fmt.Errorf("teams must have different lap barriers")
+	}
+	for i := range t.Barriers {
+		if err := t.validateGroup(&t.Barriers[i]); err != nil {
+			return err
+		}
+	}
+	if t.FusionWindow != nil && *t.FusionWindow <= 0 {
+		return fmt.Errorf("fusionWindow must be positive")
+	}
+	return validateFilter(t.DebounceTime, t.MinLapTime)
+}
+
+// track returns the track of the race. Track must be preloaded
+// (including its Barriers) for races with TrackID set.
+func (r *Race) track() *Track {
+	if r.Track == nil || r.Track.ID == 0 {
+		return &defaultTrack
+	}
+	return r.Track
+}
+
+func findTrack(trackId uint) (Track, error) {
+	var track Track
+	if err := db.Preload("Barriers").First(&track, trackId).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return track, echo.NewHTTPError(
+				http.StatusNotFound,
+				fmt.Sprintf("track with id %d not found", trackId),
+			)
+		}
+		return track, err
+	}
+	return track, nil
+}
+
+func getAllTracks(c echo.Context) error {
+	var tracks []Track
+	if err := db.Preload("Barriers").Find(&tracks).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tracks)
+}
+
+func getTrackHandler(c echo.Context) error {
+	var track Track
+	if err := c.Bind(&track); err != nil {
+		return err
+	}
+	track, err := findTrack(track.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, track)
+}
+
+func createTrack(c echo.Context) error {
+	var track Track
+	if err := c.Bind(&track); err != nil {
+		return err
+	}
+	if track.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name not specified")
+	}
+	if err := track.validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := db.Create(&track).Error; err != nil {
+		return err
+	}
+	audit(c, "track", track.ID, 0, nil, track)
+	return c.JSON(http.StatusOK, track)
+}
+
+// updateTrack replaces the track configuration including its barriers.
+func updateTrack(c echo.Context) error {
+	var track Track
+	if err := c.Bind(&track); err != nil {
+		return err
+	}
+	old, err := findTrack(track.ID)
+	if err != nil {
+		return err
+	}
+	if err := track.validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	// current races keep their track configuration in memory
+	if raceId := currentRaces.forTrack(track.ID); raceId != 0 {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("race %d is running on track %d", raceId, track.ID),
+		)
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("track_id = ?", track.ID).Delete(&TrackBarrier{}).Error; err != nil {
+			return err
+		}
+		for i := range track.Barriers {
+			track.Barriers[i].TrackID = track.ID
+		}
+		if len(track.Barriers) > 0 {
+			if err := tx.Create(&track.Barriers).Error; err != nil {
+				return err
+			}
+		}
+		// select all fields otherwise GoORM will ignore zero fields
+		fields := []string{"TeamALapBarrier", "TeamBLapBarrier", "DebounceTime", "MinLapTime", "FusionWindow"}
+		if track.Name != "" {
+			fields = append(fields, "Name")
+		}
+		return tx.Omit("Barriers").Select(fields).Updates(&track).Error
+	})
+	if err != nil {
+		return err
+	}
+	track, err = findTrack(track.ID)
+	if err != nil {
+		return err
+	}
+	audit(c, "track", track.ID, 0, old, track)
+	return c.JSON(http.StatusOK, track)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Operator changes of crossings and penalties can be undone (and
+// redone) race by race. The edit history is the audit log: undoing
+// restores the entity to the value before the change and redoing to
+// the value after it. Race state changes cannot be undone.
+var undoableEntities = []string{"crossing", "penalty"}
+
+// CrossingAudit is the value of a crossing recorded in the audit log.
+// Unlike the API, it includes the race ID so that attaching crossings
+// to races can be undone.
+type CrossingAudit struct {
+	Crossing
+	RaceID uint `json:"raceId"`
+}
+
+func crossingAudit(crossing *Crossing) *CrossingAudit {
+	return &CrossingAudit{*crossing, crossing.RaceID}
+}
+
+// historyStacks replays the race's history (audit entries ordered by
+// ID) and returns the changes that can be undone and redone, most
+// recent last.
+func historyStacks(entries []AuditEntry) (undo []AuditEntry, redo []AuditEntry) {
+	byId := make(map[uint]AuditEntry)
+	for _, e := range entries {
+		byId[e.ID] = e
+		switch {
+		case e.UndoOf != nil:
+			if len(undo) > 0 && undo[len(undo)-1].ID == *e.UndoOf {
+				undo = undo[:len(undo)-1]
+				redo = append(redo, byId[*e.UndoOf])
+			}
+		case e.RedoOf != nil:
+			if len(redo) > 0 && redo[len(redo)-1].ID == *e.RedoOf {
+				redo = redo[:len(redo)-1]
+				undo = append(undo, byId[*e.RedoOf])
+			}
+		default:
+			// a new change makes the undone changes obsolete
+			undo = append(undo, e)
+			redo = nil
+		}
+	}
+	return undo, redo
+}
+
+// applyHistoryValue sets the entity to the value recorded in the audit
+// log. A null value means the entity did not exist.
+func applyHistoryValue(tx *gorm.DB, entity string, id uint, value AuditValue) error {
+	switch entity {
+	case "crossing":
+		if value == nil {
+			return tx.Delete(&Crossing{}, id).Error
+		}
+		var v CrossingAudit
+		if err := json.Unmarshal(value, &v); err != nil {
+			return err
+		}
+		crossing := v.Crossing
+		crossing.ID, crossing.RaceID = id, v.RaceID
+		var cnt int64
+		if err := tx.Model(&Crossing{}).Where("id = ?", id).Count(&cnt).Error; err != nil {
+			return err
+		}
+		if cnt == 0 {
+			// e.g. redo of a manual crossing creation
+			return tx.Create(&crossing).Error
+		}
+		// Only fields changed by operators (or by merging attached
+		// crossings of grouped barriers) are restored. The time is
+		// kept, because it is recorded with millisecond precision.
+		return tx.Model(&crossing).
+			Select("RaceID", "BarrierId", "Boot", "Seq", "Ignored", "IgnoreReason", "Team", "Paused", "FalseStart", "TeamMismatch").
+			Updates(&crossing).Error
+	case "penalty":
+		if value == nil {
+			return tx.Delete(&Penalty{}, id).Error
+		}
+		var p Penalty
+		if err := json.Unmarshal(value, &p); err != nil {
+			return err
+		}
+		// deleted penalties are only marked as deleted
+		return tx.Unscoped().Model(&Penalty{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"deleted_at": nil,
+			"team":       p.Team,
+			"kind":       p.Kind,
+			"laps":       p.Laps,
+			"time":       p.Time,
+			"reason":     p.Reason,
+			"issued_by":  p.IssuedBy,
+		}).Error
+	}
+	return fmt.Errorf("changes of %s cannot be undone", entity)
+}
+
+// undoRaceChange undoes (or redoes) the last operator change of the
+// race's crossings or penalties and records it in the audit log.
+func undoRaceChange(c echo.Context, redo bool) error {
+	var raceId uint
+	if err := echo.PathParamsBinder(c).MustUint("id", &raceId).BindError(); err != nil {
+		return err
+	}
+	var race Race
+	if err := findRace(raceId, &race); err != nil {
+		return err
+	}
+	c.Set(auditedKey, true)
+	entry := newAuditEntry(c, "", 0, race.ID, nil, nil)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var entries []AuditEntry
+		if err := tx.Where("race_id = ? AND entity IN ?", race.ID, undoableEntities).Order("id").Find(&entries).Error; err != nil {
+			return err
+		}
+		undoStack, redoStack := historyStacks(entries)
+		stack := undoStack
+		if redo {
+			stack = redoStack
+		}
+		if len(stack) == 0 {
+			what := "undo"
+			if redo {
+				what = "redo"
+			}
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("nothing to %s in race %d", what, race.ID))
+		}
+		change := stack[len(stack)-1]
+		if change.Entity == "penalty" && !hasRole(c, RaceControl) {
+			return echo.NewHTTPError(http.StatusForbidden, "role race_control required to undo penalties")
+		}
+		entry.Entity, entry.EntityID = change.Entity, change.EntityID
+		if redo {
+			entry.Before, entry.After, entry.RedoOf = change.Before, change.After, &change.ID
+		} else {
+			entry.Before, entry.After, entry.UndoOf = change.After, change.Before, &change.ID
+		}
+		if err := applyHistoryValue(tx, change.Entity, change.EntityID, entry.After); err != nil {
+			return err
+		}
+		if err := recordAudit(tx, entry); err != nil {
+			return err
+		}
+		if err := updateFalseStarts(tx, race.ID); err != nil {
+			return err
+		}
+		// so the frontend can find out what is the latest version
+		return tx.Model(&Race{}).Where("id = ?", race.ID).Update("UpdatedAt", time.Now()).Error
+	})
+	if err != nil {
+		return err
+	}
+	if err := broadcastRace(&race); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, entry)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHistoryStacks(t *testing.T) {
+	change := func(id uint) AuditEntry {
+		return AuditEntry{ID: id}
+	}
+	undo := func(id, of uint) AuditEntry {
+		return AuditEntry{ID: id, UndoOf: &of}
+	}
+	redo := func(id, of uint) AuditEntry {
+		return AuditEntry{ID: id, RedoOf: &of}
+	}
+	tests := []struct {
+		name    string
+		entries []AuditEntry
+		// IDs of the changes that can be undone and redone
+		undo, redo []uint
+	}{
+		{"no changes", nil, nil, nil},
+		{"changes", []AuditEntry{change(1), change(2)}, []uint{1, 2}, nil},
+		{"undo", []AuditEntry{change(1), change(2), undo(3, 2)}, []uint{1}, []uint{2}},
+		{"undo and redo", []AuditEntry{change(1), change(2), undo(3, 2), redo(4, 2)}, []uint{1, 2}, nil},
+		{"two undos", []AuditEntry{change(1), change(2), undo(3, 2), undo(4, 1)}, nil, []uint{2, 1}},
+		{"two undos and redo", []AuditEntry{change(1), change(2), undo(3, 2), undo(4, 1), redo(5, 1)}, []uint{1}, []uint{2}},
+		{"new change clears redo", []AuditEntry{change(1), change(2), undo(3, 2), change(4)}, []uint{1, 4}, nil},
+		{"undo of older change ignored", []AuditEntry{change(1), change(2), undo(3, 1)}, []uint{1, 2}, nil},
+		{"redo of other change ignored", []AuditEntry{change(1), undo(2, 1), redo(3, 5)}, nil, []uint{1}},
+	}
+	ids := func(entries []AuditEntry) []uint {
+		var ids []uint
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			undo, redo := historyStacks(tt.entries)
+			if got := ids(undo); !reflect.DeepEqual(got, tt.undo) {
+				t.Errorf("undo = %v, want %v", got, tt.undo)
+			}
+			if got := ids(redo); !reflect.DeepEqual(got, tt.redo) {
+				t.Errorf("redo = %v, want %v", got, tt.redo)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Role of the user. Each role includes permissions of the roles
+// listed before it.
+type Role string
+
+const (
+	// Can read data if the backend runs with -private
+	Viewer Role = "viewer"
+	// Can edit crossings
+	Timing Role = "timing"
+	// Can create, start and stop races and issue penalties
+	RaceControl Role = "race_control"
+	// Can manage teams, events, tracks, cars, users and barriers
+	Admin Role = "admin"
+)
+
+var roleLevels = map[Role]int{Viewer: 1, Timing: 2, RaceControl: 3, Admin: 4}
+
+// How long login tokens are valid
+const sessionLifetime = 24 * time.Hour
+
+// Context key of the logged in user
+const userKey = "user"
+
+// Context key marking requests authorized by the POST key from the
+// -keys file
+const postKeyAuthKey = "postKey"
+
+// SQL interface
+
+func (e *Role) Scan(value interface{}) error {
+	s, _ := value.(string)
+	*e = Role(s)
+	return nil
+}
+
+func (e Role) Value() (driver.Value, error) {
+	return string(e), nil
+}
+
+// includes returns true if the role has permissions of role r
+func (e Role) includes(r Role) bool {
+	return roleLevels[e] >= roleLevels[r]
+}
+
+type User struct {
+	CommonModelFields
+	Name         string `gorm:"uniqueIndex" json:"name"`
+	Role         Role   `json:"role"`
+	PasswordHash string `json:"-"`
+}
+
+// Session is created by logging in. Only a hash of the token is
+// stored.
+type Session struct {
+	ID        uint   `gorm:"primaryKey"`
+	TokenHash string `gorm:"uniqueIndex"`
+	UserID    uint   `gorm:"index"`
+	User      User
+	ExpiresAt Time
+}
+
+// UserRequest creates or updates a user
+type UserRequest struct {
+	ID   uint   `param:"id"`
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+	// Empty to keep the password when updating the user
+	Password string `json:"password"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authEnabled returns true once a user account exists
+func authEnabled() (bool, error) {
+	var cnt int64
+	err := db.Model(&User{}).Count(&cnt).Error
+	return cnt > 0, err
+}
+
+// openMode returns true if anybody can change data: no -keys file is
+// configured and no user account exists, as before user accounts were
+// introduced.
+func openMode() bool {
+	if len(keys) > 0 {
+		return false
+	}
+	enabled, err := authEnabled()
+	return err == nil && !enabled
+}
+
+// checkPostKey returns true if key is the POST key from the -keys file
+func checkPostKey(key string) bool {
+	postKey, ok := keys["POST"]
+	return ok && key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(postKey)) == 1
+}
+
+// currentUser returns the user logged in by the request or nil
+func currentUser(c echo.Context) *User {
+	user, _ := c.Get(userKey).(*User)
+	return user
+}
+
+// hasRole returns true if the request is allowed to do what role r
+// can do. The POST key allows everything.
+func hasRole(c echo.Context, r Role) bool {
+	if user := currentUser(c); user != nil {
+		return user.Role.includes(r)
+	}
+	return c.Get(postKeyAuthKey) != nil || openMode()
+}
+
+// authMiddleware identifies the user by the token from the
+// Authorization header ("Bearer <token>") or, for websockets, the token
+// query parameter. The header can also contain the POST key. POST
+// requests (except logging in) require one of them unless the API is
+// in open mode. If private is true, reading data requires the viewer
+// role.
+func authMiddleware(private bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// barriers are authorized in barrierWebsockHandler
+			if strings.HasPrefix(c.Path(), "/barrier/") {
+				return next(c)
+			}
+			token := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if token == "" {
+				token = c.QueryParam("token")
+			}
+			if checkPostKey(token) {
+				c.Set(postKeyAuthKey, true)
+			} else if token != "" {
+				var session Session
+				err := db.Preload("User").Where("token_hash = ? AND expires_at > ?", hashToken(token), time.Now()).
+					Limit(1).Find(&session).Error
+				if err != nil {
+					return err
+				}
+				if session.ID == 0 {
+					return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired token")
+				}
+				c.Set(userKey, &session.User)
+			}
+			if c.Request().Method == http.MethodPost && c.Path() != "/login" &&
+				currentUser(c) == nil && c.Get(postKeyAuthKey) == nil && !openMode() {
+				return echo.NewHTTPError(http.StatusUnauthorized, "login required")
+			}
+			if private && c.Request().Method == http.MethodGet && c.Path() != "/" && !hasRole(c, Viewer) {
+				return echo.NewHTTPError(http.StatusUnauthorized, "login required")
+			}
+			return next(c)
+		}
+	}
+}
+
+// requireRole allows the request only to users with the role
+func requireRole(r Role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !hasRole(c, r) {
+				if currentUser(c) == nil {
+					return echo.NewHTTPError(http.StatusUnauthorized, "login required")
+				}
+				return echo.NewHTTPError(
+					http.StatusForbidden,
+					fmt.Sprintf("role %s required", string(r)),
+				)
+			}
+			return next(c)
+		}
+	}
+}
+
+func login(c echo.Context) error {
+	var req UserRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	var user User
+	if err := db.Where("name = ?", req.Name).Limit(1).Find(&user).Error; err != nil {
+		return err
+	}
+	if user.ID == 0 || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid name or password")
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	session := Session{TokenHash: hashToken(token), UserID: user.ID, ExpiresAt: Time(time.Now().Add(sessionLifetime))}
+	if err := db.Omit("User").Create(&session).Error; err != nil {
+		return err
+	}
+	c.Set(userKey, &user)
+	audit(c, "user", user.ID, 0, nil, nil)
+	return c.JSON(http.StatusOK, &struct {
+		Token     string `json:"token"`
+		ExpiresAt Time   `json:"expiresAt"`
+		User      User   `json:"user"`
+	}{token, session.ExpiresAt, user})
+}
+
+func logout(c echo.Context) error {
+	token := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if err := db.Where("token_hash = ?", hashToken(token)).Delete(&Session{}).Error; err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func findUser(id uint, user *User) error {
+	if err := db.First(user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(
+				http.StatusNotFound,
+				fmt.Sprintf("user with id %d not found", id),
+			)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkLastAdmin returns an error if the user is the only admin, so
+// that nobody could manage users anymore after removing them.
+func checkLastAdmin(user *User) error {
+	if user.Role != Admin {
+		return nil
+	}
+	var cnt int64
+	if err := db.Model(&User{}).Where("role = ? AND id <> ?", Admin, user.ID).Count(&cnt).Error; err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "the last admin cannot be removed")
+	}
+	return nil
+}
+
+func getAllUsers(c echo.Context) error {
+	var users []User
+	if err := db.Find(&users).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, users)
+}
+
+// createUser creates a user account. The first account must be an
+// admin and it can be created only with the POST key (or by the
+// -create-admin command line parameter).
+func createUser(c echo.Context) error {
+	var req UserRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Name == "" || req.Password == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name and password must be specified")
+	}
+	if _, ok := roleLevels[req.Role]; !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported role '%s'", string(req.Role)))
+	}
+	if enabled, err := authEnabled(); err != nil {
+		return err
+	} else if !enabled && req.Role != Admin {
+		return echo.NewHTTPError(http.StatusBadRequest, "the first user must be an admin")
+	} else if !enabled && c.Get(postKeyAuthKey) == nil {
+		return echo.NewHTTPError(http.StatusForbidden, "the first admin can be created only with the POST key or -create-admin")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user := User{Name: req.Name, Role: req.Role, PasswordHash: string(hash)}
+	if err := db.Create(&user).Error; err != nil {
+		return err
+	}
+	audit(c, "user", user.ID, 0, nil, user)
+	return c.JSON(http.StatusOK, user)
+}
+
+func updateUser(c echo.Context) error {
+	var req UserRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	var user User
+	if err := findUser(req.ID, &user); err != nil {
+		return err
+	}
+	before := user
+	if req.Name != "" {
+		user.Name = req.Name
+	}
+	if req.Role != "" && req.Role != user.Role {
+		if _, ok := roleLevels[req.Role]; !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported role '%s'", string(req.Role)))
+		}
+		if err := checkLastAdmin(&user); err != nil {
+			return err
+		}
+		user.Role = req.Role
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = string(hash)
+	}
+	if err := db.Save(&user).Error; err != nil {
+		return err
+	}
+	audit(c, "user", user.ID, 0, before, user)
+	return c.JSON(http.StatusOK, user)
+}
+
+func deleteUser(c echo.Context) error {
+	var req UserRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	var user User
+	if err := findUser(req.ID, &user); err != nil {
+		return err
+	}
+	if err := checkLastAdmin(&user); err != nil {
+		return err
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&Session{}).Error; err != nil {
+			return err
+		}
+		// hard delete, so that the name can be used again
+		return tx.Unscoped().Delete(&user).Error
+	})
+	if err != nil {
+		return err
+	}
+	audit(c, "user", user.ID, 0, user, nil)
+	return c.JSON(http.StatusOK, user)
+}
+
+// createAdmin creates an admin account with the password from the
+// SCOREAPP_ADMIN_PASSWORD environment variable unless the user exists.
+func createAdmin(name string) {
+	password := os.Getenv("SCOREAPP_ADMIN_PASSWORD")
+	if password == "" {
+		log.Fatalf("create admin: SCOREAPP_ADMIN_PASSWORD not set")
+	}
+	var user User
+	if err := db.Where("name = ?", name).Limit(1).Find(&user).Error; err != nil {
+		log.Fatalf("create admin: %v", err)
+	}
+	if user.ID != 0 {
+		log.Printf("user %s already exists", name)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalf("create admin: %v", err)
+	}
+	user = User{Name: name, Role: Admin, PasswordHash: string(hash)}
+	if err := db.Create(&user).Error; err != nil {
+		log.Fatalf("create admin: %v", err)
+	}
+	log.Printf("created admin %s", name)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// testSession stores a user with the role and returns the login token
+func testSession(t *testing.T, role Role, expiresAt time.Time) string {
+	t.Helper()
+	user := User{Name: string(role) + expiresAt.String(), Role: role}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	token := "token-" + user.Name
+	session := Session{TokenHash: hashToken(token), UserID: user.ID, ExpiresAt: Time(expiresAt)}
+	if err := db.Create(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testAuthServer returns a server with the auth middleware and routes
+// requiring various roles, all of them succeeding if allowed
+func testAuthServer(private bool) *echo.Echo {
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e := echo.New()
+	e.Use(authMiddleware(private))
+	e.GET("/races", ok)
+	e.POST("/login", ok)
+	e.POST("/crossings/:id", ok, requireRole(Timing))
+	e.POST("/races", ok, requireRole(RaceControl))
+	e.GET("/users", ok, requireRole(Admin))
+	return e
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	setupTestDb(t)
+	now := time.Now()
+	viewer := testSession(t, Viewer, now.Add(time.Hour))
+	timing := testSession(t, Timing, now.Add(time.Hour))
+	raceControl := testSession(t, RaceControl, now.Add(time.Hour))
+	admin := testSession(t, Admin, now.Add(time.Hour))
+	expired := testSession(t, Admin, now.Add(-time.Hour))
+	keys = map[string]string{"POST": "post-key"}
+
+	tests := []struct {
+		name         string
+		private      bool
+		method, path string
+		token        string
+		want         int
+	}{
+		{"anonymous read", false, http.MethodGet, "/races", "", http.StatusOK},
+		{"anonymous write", false, http.MethodPost, "/crossings/1", "", http.StatusUnauthorized},
+		{"anonymous login", false, http.MethodPost, "/login", "", http.StatusOK},
+		{"invalid token", false, http.MethodGet, "/races", "foo", http.StatusUnauthorized},
+		{"expired token", false, http.MethodPost, "/races", expired, http.StatusUnauthorized},
+		{"viewer write", false, http.MethodPost, "/crossings/1", viewer, http.StatusForbidden},
+		{"timing edits crossings", false, http.MethodPost, "/crossings/1", timing, http.StatusOK},
+		{"timing creates race", false, http.MethodPost, "/races", timing, http.StatusForbidden},
+		{"race control creates race", false, http.MethodPost, "/races", raceControl, http.StatusOK},
+		{"race control edits crossings", false, http.MethodPost, "/crossings/1", raceControl, http.StatusOK},
+		{"race control lists users", false, http.MethodGet, "/users", raceControl, http.StatusForbidden},
+		{"admin lists users", false, http.MethodGet, "/users", admin, http.StatusOK},
+		{"post key", false, http.MethodPost, "/races", "post-key", http.StatusOK},
+		{"private anonymous read", true, http.MethodGet, "/races", "", http.StatusUnauthorized},
+		{"private viewer read", true, http.MethodGet, "/races", viewer, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			testAuthServer(tt.private).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareOpenMode(t *testing.T) {
+	setupTestDb(t)
+	req := httptest.NewRequest(http.MethodPost, "/races", nil)
+	rec := httptest.NewRecorder()
+	testAuthServer(false).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("POST /races without users and keys = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// once a user exists, changes require login
+	testSession(t, Admin, time.Now().Add(time.Hour))
+	rec = httptest.NewRecorder()
+	testAuthServer(false).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/races", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST /races with a user = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
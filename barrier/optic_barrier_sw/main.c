@@ -32,6 +32,8 @@
 #include <stdbool.h>
 #include <pthread.h>
 #include <stdint.h>
+#include <fcntl.h>
+#include <errno.h>
 
 #include <wiringPi.h>
 
@@ -49,6 +51,18 @@
 
 #define MIN_TIME_US 1000000
 
+/* Detections are resent until the server acknowledges them */
+#define ACK_TIMEOUT_US 2000000
+#define MAX_PENDING 256
+/* How often the health status is reported to the server */
+#define STATUS_PERIOD_US 10000000
+/* Last used sequence number survives restarts in this file (the
+ * directory is created by systemd, see StateDirectory in
+ * optic_barrier.service) */
+#ifndef SEQ_FILE
+#define SEQ_FILE "/var/lib/optic_barrier/optic_barrier.seq"
+#endif
+
 pthread_mutex_t detect_mutex = PTHREAD_MUTEX_INITIALIZER;
 bool object_detected = false;
 struct timeval detect_time;
@@ -157,6 +171,205 @@ int64_t usec_between(const struct timeval *start, const struct timeval *stop)
     return (stop->tv_sec - start->tv_sec) * 1000000LL + stop->tv_usec - start->tv_usec;
 }
 
+struct detection {
+    uint64_t seq;
+    int64_t timestamp_us;
+    struct timeval sent;
+};
+
+/* Detections not yet acknowledged by the server */
+static struct detection pending[MAX_PENDING];
+static int pending_cnt = 0;
+static uint64_t seq = 0;
+/* Random identifier of this run sent with each detection, so that the
+ * server does not take detections for duplicates if the sequence
+ * numbers restart (e.g. when SEQ_FILE is lost) */
+static uint32_t boot_id = 0;
+
+void init_boot_id()
+{
+    FILE *f = fopen("/dev/urandom", "r");
+    if (!f || fread(&boot_id, sizeof(boot_id), 1, f) != 1) {
+        struct timeval now;
+        gettimeofday(&now, NULL);
+        boot_id = now.tv_sec ^ now.tv_usec ^ getpid();
+    }
+    if (f)
+        fclose(f);
+}
+
+void load_seq()
+{
+    FILE *f = fopen(SEQ_FILE, "r");
+    if (f) {
+        if (fscanf(f, "%llu", (unsigned long long *)&seq) != 1)
+            seq = 0;
+        fclose(f);
+    }
+}
+
+void save_seq()
+{
+    FILE *f = fopen(SEQ_FILE, "w");
+    if (!f) {
+        perror(SEQ_FILE);
+        return;
+    }
+    fprintf(f, "%llu\n", (unsigned long long)seq);
+    fclose(f);
+}
+
+void send_detection(struct detection *d)
+{
+    printf("{\"boot\":%lu,\"seq\":%llu,\"timestamp\":%lld}\n", (unsigned long)boot_id,
+           (unsigned long long)d->seq, (long long)d->timestamp_us);
+    fflush(stdout);
+    gettimeofday(&d->sent, NULL);
+}
+
+void add_detection(int64_t timestamp_us)
+{
+    if (pending_cnt == MAX_PENDING) {
+        fprintf(stderr, "Pending queue full, dropping detection %llu\n", (unsigned long long)pending[0].seq);
+        memmove(&pending[0], &pending[1], (MAX_PENDING - 1) * sizeof(pending[0]));
+        pending_cnt--;
+    }
+    struct detection *d = &pending[pending_cnt++];
+    d->seq = ++seq;
+    d->timestamp_us = timestamp_us;
+    save_seq();
+    send_detection(d);
+}
+
+void ack_detection(uint64_t ack)
+{
+    for (int i = 0; i < pending_cnt; i++) {
+        if (pending[i].seq == ack) {
+            memmove(&pending[i], &pending[i + 1], (pending_cnt - i - 1) * sizeof(pending[0]));
+            pending_cnt--;
+            return;
+        }
+    }
+}
+
+/* Replies to the server's clock synchronization request
+ * ({"timeRequest":{"t0":N}}) with our time */
+void time_response(const char *line, const struct timeval *received)
+{
+    const char *t0 = strstr(line, "\"t0\":");
+    if (!t0)
+        return;
+    struct timeval now;
+    gettimeofday(&now, NULL);
+    printf("{\"timeResponse\":{\"t0\":%lld,\"t1\":%lld,\"t2\":%lld}}\n",
+           strtoll(t0 + strlen("\"t0\":"), NULL, 10),
+           received->tv_sec * 1000000LL + received->tv_usec,
+           now.tv_sec * 1000000LL + now.tv_usec);
+    fflush(stdout);
+}
+
+/* Reports firmware version, uptime, sensor state, CPU temperature and
+ * Wi-Fi signal level to the server every STATUS_PERIOD_US */
+void send_status()
+{
+    static struct timeval last;
+    struct timeval now;
+    gettimeofday(&now, NULL);
+    if (last.tv_sec != 0 && usec_between(&last, &now) < STATUS_PERIOD_US)
+        return;
+    last = now;
+
+    double uptime = 0;
+    FILE *f = fopen("/proc/uptime", "r");
+    if (f) {
+        if (fscanf(f, "%lf", &uptime) != 1)
+            uptime = 0;
+        fclose(f);
+    }
+    printf("{\"status\":{\"firmwareVersion\":\"%s%s\",\"uptime\":%llu,\"sensor\":\"%s\"",
+           GIT_AVAILABLE ? GIT_DESCRIBE : "unknown", GIT_AVAILABLE && GIT_IS_DIRTY ? "-dirty" : "",
+           (unsigned long long)uptime, digitalRead(BARRIER_SIGNAL) ? "blocked" : "clear");
+
+    int millideg;
+    f = fopen("/sys/class/thermal/thermal_zone0/temp", "r");
+    if (f) {
+        if (fscanf(f, "%d", &millideg) == 1)
+            printf(",\"cpuTemperature\":%.1f", millideg / 1000.0);
+        fclose(f);
+    }
+
+    /* Format: "wlan0: 0000   70.  -40.  -256 ..." (level in dBm) */
+    f = fopen("/proc/net/wireless", "r");
+    if (f) {
+        char line[256];
+        int status;
+        float link, level;
+        while (fgets(line, sizeof(line), f)) {
+            char *colon = strchr(line, ':');
+            if (colon && sscanf(colon + 1, "%x %f %f", &status, &link, &level) == 3) {
+                printf(",\"wifiSignal\":%d", (int)level);
+                break;
+            }
+        }
+        fclose(f);
+    }
+    printf("}}\n");
+    fflush(stdout);
+}
+
+/* Reads messages sent by the server to our stdin (non-blocking):
+ * acknowledgements ({"ack":N,...}) and time requests */
+void process_server_messages()
+{
+    static char buf[1024];
+    static size_t len = 0;
+    ssize_t n;
+
+    while ((n = read(STDIN_FILENO, buf + len, sizeof(buf) - 1 - len)) > 0) {
+        struct timeval received;
+        gettimeofday(&received, NULL);
+        len += n;
+        buf[len] = '\0';
+        char *line = buf, *nl;
+        while ((nl = strchr(line, '\n')) != NULL) {
+            *nl = '\0';
+            char *ack = strstr(line, "\"ack\":");
+            if (ack)
+                ack_detection(strtoull(ack + strlen("\"ack\":"), NULL, 10));
+            else if (strstr(line, "\"timeRequest\""))
+                time_response(line, &received);
+            line = nl + 1;
+        }
+        len = strlen(line);
+        memmove(buf, line, len);
+        if (len == sizeof(buf) - 1)
+            len = 0; /* too long line, drop it */
+    }
+    if (n < 0 && errno != EAGAIN && errno != EWOULDBLOCK)
+        perror("stdin");
+}
+
+/* Resends detections not acknowledged in time (e.g. because the
+ * server was unreachable) in a single batch message, so that the
+ * server can assign them to the race running at their timestamps */
+void resend_pending()
+{
+    struct timeval now;
+    gettimeofday(&now, NULL);
+    int cnt = 0;
+    for (int i = 0; i < pending_cnt; i++) {
+        if (usec_between(&pending[i].sent, &now) <= ACK_TIMEOUT_US)
+            continue;
+        printf("%s{\"boot\":%lu,\"seq\":%llu,\"timestamp\":%lld}", cnt++ ? "," : "{\"batch\":[",
+               (unsigned long)boot_id, (unsigned long long)pending[i].seq, (long long)pending[i].timestamp_us);
+        pending[i].sent = now;
+    }
+    if (cnt) {
+        printf("]}\n");
+        fflush(stdout);
+    }
+}
+
 int roll_time = 5;
 int roll_current_time = 0;
 bool roll = false;
@@ -315,6 +528,10 @@ int main(int argc, char *argv[])
         printf("Unable to setup ISR \n");
     }
 
+    init_boot_id();
+    load_seq();
+    fcntl(STDIN_FILENO, F_SETFL, fcntl(STDIN_FILENO, F_GETFL) | O_NONBLOCK);
+
     bool detect_in_progress = false;
     bool after_start = false;
     state.time_us = 0;
@@ -372,12 +589,15 @@ int main(int argc, char *argv[])
                     start = local_detect_time;
                     after_start = true;
 
-                    printf("{\"timestamp\":%lld}\n", local_detect_time.tv_sec * 1000000LL + local_detect_time.tv_usec);
+                    add_detection(local_detect_time.tv_sec * 1000000LL + local_detect_time.tv_usec);
                 }
             } else {
                 detect_in_progress = false;
             }
         }
+        process_server_messages();
+        resend_pending();
+        send_status();
         usleep(1000); // wait 1ms
     }
     System_Exit();